@@ -47,7 +47,8 @@ def push_element_to_queue(timestamp, username, user_id, type_event, sub_tier, su
             "event_type": type_event,
             "user_tier": sub_tier,
             "months": sub_months,
-            "n_bits": quantity if type_event == "bits" else None
+            "n_bits": quantity if type_event == "bits" else None,
+            "quantity": quantity if type_event in ("subgift", "submysterygift") else None
         }
     }
 
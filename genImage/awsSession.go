@@ -0,0 +1,20 @@
+// this module creates the AWS session shared by the clients of the service
+
+package main
+
+import (
+	"genImage/config"
+
+	"subvisionCore/awsclient"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newAWSSession creates an AWS session from the configured credentials
+func newAWSSession(awsSecrets config.AWSSecrets) (*session.Session, error) {
+	return awsclient.NewSession(awsclient.Credentials{
+		Region:          awsSecrets.Region,
+		AccessKeyID:     awsSecrets.AccessKeyID,
+		SecretAccessKey: awsSecrets.SecretAccessKey,
+	})
+}
@@ -0,0 +1,143 @@
+// this module implements the catalog command used to search the generated images by their metadata
+//
+//	genImage catalog [-user id|name] [-rarity name] [-model id] [-provider name] [-event type] [-since 7d] [-until 2006-01-02] [-json]
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// catalogFilter selects images of the catalog
+type catalogFilter struct {
+	user      string
+	rarity    string
+	model     string
+	provider  string
+	eventType string
+	since     time.Time
+	until     time.Time
+}
+
+// matches reports whether the image satisfies every filter that is set
+func (f catalogFilter) matches(metadata ImageMetadata) bool {
+	if f.user != "" && f.user != strconv.Itoa(metadata.UserID) && !strings.EqualFold(f.user, metadata.Username) {
+		return false
+	}
+	if f.rarity != "" && !strings.EqualFold(f.rarity, metadata.Rarity) {
+		return false
+	}
+	if f.model != "" && f.model != metadata.Model {
+		return false
+	}
+	if f.provider != "" && !strings.EqualFold(f.provider, metadata.Provider) {
+		return false
+	}
+	if f.eventType != "" && f.eventType != metadata.Event.EventType {
+		return false
+	}
+
+	createdAt := metadata.createdAt()
+	if !f.since.IsZero() && createdAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !createdAt.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// runCatalogCommand searches the catalog and returns the process exit code
+func runCatalogCommand(catalogStore ImageStore, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("catalog", flag.ContinueOnError)
+	flags.SetOutput(out)
+	user := flags.String("user", "", "only images of this user ID or username")
+	rarity := flags.String("rarity", "", "only images of this rarity, like legendary")
+	model := flags.String("model", "", "only images of this model ID")
+	provider := flags.String("provider", "", "only images of this image provider")
+	eventType := flags.String("event", "", "only images triggered by this event type, like resub")
+	since := flags.String("since", "", "only images generated after this date (2006-01-02) or in this last period (7d, 12h)")
+	until := flags.String("until", "", "only images generated before this date (2006-01-02)")
+	asJSON := flags.Bool("json", false, "print the full metadata as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	filter := catalogFilter{user: *user, rarity: *rarity, model: *model, provider: *provider, eventType: *eventType}
+	var err error
+	if filter.since, err = parseCatalogTime(*since); err != nil {
+		fmt.Fprintf(out, "invalid -since: %v\n", err)
+		return 2
+	}
+	if filter.until, err = parseCatalogTime(*until); err != nil {
+		fmt.Fprintf(out, "invalid -until: %v\n", err)
+		return 2
+	}
+
+	catalog, err := loadImageMetadata(context.Background(), catalogStore)
+	if err != nil {
+		fmt.Fprintf(out, "Error reading the catalog: %v\n", err)
+		return 1
+	}
+
+	var matching []ImageMetadata
+	for _, metadata := range catalog {
+		if filter.matches(metadata) {
+			matching = append(matching, metadata)
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		for _, metadata := range matching {
+			encoder.Encode(metadata)
+		}
+		return 0
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "CREATED\tUSER\tEVENT\tRARITY\tMODEL\tIMAGE")
+	for _, metadata := range matching {
+		fmt.Fprintf(writer, "%s\t%s (%d)\t%s\t%s\t%s\t%s\n", metadata.CreatedAt, metadata.Username, metadata.UserID,
+			metadata.Event.EventType, metadata.Rarity, metadata.Model, metadata.ImagePath)
+	}
+	writer.Flush()
+	fmt.Fprintf(out, "%d of %d images\n", len(matching), len(catalog))
+	return 0
+}
+
+// parseCatalogTime parses a date like 2006-01-02, an RFC 3339 time, or a period back from now like 7d or 12h
+func parseCatalogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	// time.ParseDuration doesn't know days
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("expected a date, a time or a period like 7d, got %q", value)
+		}
+		return time.Now().AddDate(0, 0, -n), nil
+	}
+	period, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a date, a time or a period like 7d, got %q", value)
+	}
+	return time.Now().Add(-period), nil
+}
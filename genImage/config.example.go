@@ -0,0 +1,90 @@
+//go:build ignore
+
+// this module is an example of the config package holding the secrets of genImage. The package is not
+// committed, copy this file to config/config.go, remove the build constraint and fill in the values.
+// The optional secrets disable what they configure when they are left empty, as noted on each of them.
+
+package config
+
+// AWSSecrets are the credentials and the queues used for SQS, DynamoDB and S3
+type AWSSecrets struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SubsToProcessSqsQueueURL is the queue of the events to generate an image for
+	SubsToProcessSqsQueueURL string
+	// SubsToProcessSqsDlqQueueURL is the dead letter queue of the events that failed
+	SubsToProcessSqsDlqQueueURL string
+	// ReadyImagesSqsQueueURL is the queue the overlay reads the generated images from
+	ReadyImagesSqsQueueURL string
+}
+
+func GetAWSSecrets() AWSSecrets {
+	return AWSSecrets{
+		Region:                      "eu-west-1",
+		AccessKeyID:                 "",
+		SecretAccessKey:             "",
+		SubsToProcessSqsQueueURL:    "https://sqs.eu-west-1.amazonaws.com/123456789012/subs-to-process.fifo",
+		SubsToProcessSqsDlqQueueURL: "https://sqs.eu-west-1.amazonaws.com/123456789012/subs-to-process-dlq.fifo",
+		ReadyImagesSqsQueueURL:      "https://sqs.eu-west-1.amazonaws.com/123456789012/ready-images.fifo",
+	}
+}
+
+// RunwareAPISecrets is the key of the runware provider, only required when it is used
+type RunwareAPISecrets struct {
+	APIKey string
+}
+
+func GetRunwareAPISecrets() RunwareAPISecrets {
+	return RunwareAPISecrets{APIKey: ""}
+}
+
+// GoogleAPISecrets is the key of the gemini provider, only required when it is used
+type GoogleAPISecrets struct {
+	APIKey string
+}
+
+func GetGoogleAPISecrets() GoogleAPISecrets {
+	return GoogleAPISecrets{APIKey: ""}
+}
+
+// DiscordSecrets configure the discord sink: it posts to WebhookURL if set, otherwise with the bot Token
+// to ChannelId. The sink is disabled if neither is set.
+type DiscordSecrets struct {
+	Token     string
+	ChannelId string
+	// WebhookURL is https://discord.com/api/webhooks/<id>/<token>
+	WebhookURL string
+}
+
+func GetDiscordSecrets() DiscordSecrets {
+	return DiscordSecrets{
+		Token:      "",
+		ChannelId:  "",
+		WebhookURL: "",
+	}
+}
+
+// TelegramSecrets configure the alerts of the failures, they are disabled unless both are set.
+// The telegram sinks post with BotToken to ChatID, unless their settings set another chat.
+type TelegramSecrets struct {
+	BotToken string
+	ChatID   string
+}
+
+func GetTelegramSecrets() TelegramSecrets {
+	return TelegramSecrets{
+		BotToken: "",
+		ChatID:   "",
+	}
+}
+
+// WebhookSecrets configure the webhook sinks, SigningSecret is the key of the X-SubVision-Signature HMAC.
+// It is required once a webhook sink is configured in settings.json.
+type WebhookSecrets struct {
+	SigningSecret string
+}
+
+func GetWebhookSecrets() WebhookSecrets {
+	return WebhookSecrets{SigningSecret: ""}
+}
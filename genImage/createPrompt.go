@@ -1,34 +1,105 @@
 // this module takes the user description and create the prompt for image generation
-// it takes the random attributes from the json file
+// it takes the random attributes from the json file and the modifiers for the triggering event
 
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
-	"strings"
+	"os"
+	"sync"
 	"time"
 )
 
 // PromptData represents the structure of the JSON file containing prompt components
 type PromptData struct {
-	BasePrompt 	string   `json:"base_prompt"`
+	BasePrompts	[]BasePrompt `json:"base_prompts"`
 	SignTexts  	[]string `json:"sign_texts"`
 	Emotions   	[]string `json:"emotions"`
 	Backgrounds []string `json:"backgrounds"`
 	Actions   	[]string `json:"actions"`
+	EventModifiers	EventModifiers `json:"event_modifiers"`
+	Rarities	[]Rarity `json:"rarities"`
+}
+
+// EventModifiers are the prompt fragments chosen from the event that triggered the generation,
+// so bigger support yields a more special image
+type EventModifiers struct {
+	// EventTypes maps an event type (sub, resub, subgift, submysterygift, bits) to its fragment
+	EventTypes map[string]string `json:"event_types"`
+	// Tiers maps a subscription tier (Prime, Tier1, Tier2, Tier3) to its fragment
+	Tiers map[string]string `json:"tiers"`
+	// MonthMilestones are used when the cumulative months match exactly
+	MonthMilestones []MonthMilestone `json:"month_milestones"`
+	// BitsLevels are matched by the highest MinBits not greater than the cheered bits
+	BitsLevels []BitsLevel `json:"bits_levels"`
+	// GiftBombLevels are matched by the highest MinQuantity not greater than the subscriptions of a gift bomb
+	GiftBombLevels []GiftBombLevel `json:"gift_bomb_levels"`
+}
+
+// Rarity is a rarity tier that can be rolled for a generation, with its relative weight
+// and the fragment added to the prompt (empty for the ordinary tier)
+type Rarity struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+	Prompt string `json:"prompt"`
+}
+
+// GeneratedPrompt is a prompt together with the attributes rolled to build it
+type GeneratedPrompt struct {
+	Text           string
+	Background     string
+	Emotion        string
+	ActionOrSign   string
+	EventModifiers []string
+	Rarity         string
+	BasePrompt     string
+	// RequiredFeatures are the model features needed to render the prompt well, like text_rendering for a sign
+	RequiredFeatures []string
+}
+
+// MonthMilestone is a fragment used for a subscription anniversary
+type MonthMilestone struct {
+	Months int    `json:"months"`
+	Text   string `json:"text"`
+}
+
+// BitsLevel is a fragment used when at least MinBits are cheered
+type BitsLevel struct {
+	MinBits int    `json:"min_bits"`
+	Text    string `json:"text"`
+}
+
+// GiftBombLevel is a fragment used when at least MinQuantity subscriptions are gifted at once
+type GiftBombLevel struct {
+	MinQuantity int    `json:"min_quantity"`
+	Text        string `json:"text"`
+}
+
+// lockedRand is a random number generator safe for concurrent use by the workers
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// Intn returns a random number in [0, n)
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
 }
 
 var promptData *PromptData
-var rng *rand.Rand
+var rng *lockedRand
 
 // init initializes the random number generator and loads prompt data
 func init() {
 	// Initialize random number generator with current time as seed
-	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	rng = &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
 	
 	// Load prompt data from JSON file
 	loadPromptData()
@@ -38,17 +109,26 @@ func init() {
 func loadPromptData() {
 	data, err := ioutil.ReadFile("prompt_data.json")
 	if err != nil {
-		log.Fatalf("Error reading prompt_data.json: %v", err)
+		slog.Error("Error reading prompt_data.json", "error", err)
+		os.Exit(1)
 	}
 
 	promptData = &PromptData{}
 	err = json.Unmarshal(data, promptData)
 	if err != nil {
-		log.Fatalf("Error parsing prompt_data.json: %v", err)
+		slog.Error("Error parsing prompt_data.json", "error", err)
+		os.Exit(1)
+	}
+
+	// A broken template or an empty list would otherwise only show up in the generated images
+	err = validatePromptData(promptData)
+	if err != nil {
+		slog.Error("Invalid prompt_data.json", "error", err)
+		os.Exit(1)
 	}
 
-	log.Printf("Loaded prompt data: %d backgrounds, %d emotions, %d actions, %d sign texts", 
-		len(promptData.Backgrounds), len(promptData.Emotions), len(promptData.Actions), len(promptData.SignTexts))
+	slog.Info("Loaded prompt data", "base_prompts", len(promptData.BasePrompts), "backgrounds", len(promptData.Backgrounds),
+		"emotions", len(promptData.Emotions), "actions", len(promptData.Actions), "sign_texts", len(promptData.SignTexts), "rarities", len(promptData.Rarities))
 }
 
 // getRandomBackground returns a random background from the list
@@ -88,46 +168,181 @@ func shouldUseSign() bool {
 	return rng.Intn(100) < 30 // 30% chance for sign, 70% for action
 }
 
-// shouldBeGolden determines if this should be a special golden generation (2% chance)
-func shouldBeGolden() bool {
-	return rng.Intn(100) < 2 // 2% chance for golden special
-}
-
-// getActionOrSign returns either an action or a sign text based on random selection
-func getActionOrSign() string {
+// getActionOrSign returns either an action or a sign text based on random selection,
+// and whether it is a sign
+func getActionOrSign() (string, bool) {
 	if shouldUseSign() {
 		signText := getRandomSignText()
-		return fmt.Sprintf("holding a sign that says \"%s\"", signText)
+		return fmt.Sprintf("holding a sign that says \"%s\"", signText), true
+	}
+	return getRandomAction(), false
+}
+
+// weightedIndex picks an index with a probability proportional to its weight, non positive weights are never picked.
+// It returns -1 if no weight is positive.
+func weightedIndex(weights []int) int {
+	total := 0
+	for _, weight := range weights {
+		if weight > 0 {
+			total += weight
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+
+	roll := rng.Intn(total)
+	for i, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		if roll < weight {
+			return i
+		}
+		roll -= weight
+	}
+	return -1
+}
+
+// rollRarity picks a rarity tier according to the weights, it returns an empty Rarity if none is configured
+func rollRarity() Rarity {
+	weights := make([]int, len(promptData.Rarities))
+	for i, rarity := range promptData.Rarities {
+		weights[i] = rarity.Weight
+	}
+
+	i := weightedIndex(weights)
+	if i < 0 {
+		return Rarity{}
+	}
+	return promptData.Rarities[i]
+}
+
+// pickBasePrompt picks one of the base prompts according to the weights. The base prompts dedicated
+// to the event type are preferred, the generic ones are used when there is none.
+func pickBasePrompt(eventType string) *BasePrompt {
+	dedicated := make([]int, len(promptData.BasePrompts))
+	generic := make([]int, len(promptData.BasePrompts))
+	for i, basePrompt := range promptData.BasePrompts {
+		if len(basePrompt.EventTypes) == 0 {
+			generic[i] = basePrompt.Weight
+		} else if basePrompt.forEvent(eventType) {
+			dedicated[i] = basePrompt.Weight
+		}
+	}
+
+	if i := weightedIndex(dedicated); i >= 0 {
+		return &promptData.BasePrompts[i]
 	}
-	return getRandomAction()
+	// loadPromptData makes sure there is at least a generic base prompt with a positive weight
+	return &promptData.BasePrompts[weightedIndex(generic)]
 }
 
-// getGoldenSpecial returns the golden special text if applicable
-func getGoldenSpecial() string {
-	if shouldBeGolden() {
-		return "\n\nThis is a special generation, make it all golden like its something rare."
+// giftQuantity returns the number of subscriptions gifted by the event, 0 if it is not a gift
+func giftQuantity(event Event) int {
+	if event.Quantity == nil {
+		return 0
 	}
-	return ""
+	return *event.Quantity
 }
 
-// createPrompt creates the complete prompt by combining user description with random system specifications
-func createPrompt(userDescription string) string {
+// getEventModifiers returns the fragments matching the event, in the order they are added to the prompt
+func getEventModifiers(event Event) []string {
+	modifiers := promptData.EventModifiers
+	var fragments []string
+
+	if text, ok := modifiers.EventTypes[event.EventType]; ok {
+		fragments = append(fragments, text)
+	}
+
+	if text, ok := modifiers.Tiers[event.UserTier]; ok {
+		fragments = append(fragments, text)
+	}
+
+	for _, milestone := range modifiers.MonthMilestones {
+		if milestone.Months == event.Months {
+			fragments = append(fragments, milestone.Text)
+			break
+		}
+	}
+
+	if event.NBits != nil {
+		bitsLevel := -1
+		for i, level := range modifiers.BitsLevels {
+			if *event.NBits >= level.MinBits && (bitsLevel < 0 || level.MinBits > modifiers.BitsLevels[bitsLevel].MinBits) {
+				bitsLevel = i
+			}
+		}
+		if bitsLevel >= 0 {
+			fragments = append(fragments, modifiers.BitsLevels[bitsLevel].Text)
+		}
+	}
+
+	if event.EventType == "submysterygift" {
+		giftBombLevel := -1
+		for i, level := range modifiers.GiftBombLevels {
+			if giftQuantity(event) >= level.MinQuantity && (giftBombLevel < 0 || level.MinQuantity > modifiers.GiftBombLevels[giftBombLevel].MinQuantity) {
+				giftBombLevel = i
+			}
+		}
+		if giftBombLevel >= 0 {
+			fragments = append(fragments, modifiers.GiftBombLevels[giftBombLevel].Text)
+		}
+	}
+
+	return fragments
+}
+
+// createPrompt creates the complete prompt by rendering one of the base prompts with the user description,
+// random system specifications and the modifiers of the event that triggered the generation
+func createPrompt(ctx context.Context, userDescription string, event Event) (GeneratedPrompt, error) {
 	// Get random system specifications
 	background := getRandomBackground()
 	emotion := getRandomEmotion()
-	actionOrSign := getActionOrSign()
-	goldenSpecial := getGoldenSpecial()
+	actionOrSign, isSign := getActionOrSign()
+	eventModifiers := getEventModifiers(event)
+	rarity := rollRarity()
+	basePrompt := pickBasePrompt(event.EventType)
+
+	bits := 0
+	if event.NBits != nil {
+		bits = *event.NBits
+	}
+
+	prompt, err := basePrompt.render(PromptTemplateData{
+		UserDescription: userDescription,
+		Background:      background,
+		Emotion:         emotion,
+		ActionOrSign:    actionOrSign,
+		EventType:       event.EventType,
+		UserTier:        event.UserTier,
+		Months:          event.Months,
+		Bits:            bits,
+		GiftCount:       giftQuantity(event),
+		EventModifiers:  eventModifiers,
+		Rarity:          rarity.Name,
+		RarityPrompt:    rarity.Prompt,
+	})
+	if err != nil {
+		return GeneratedPrompt{}, fmt.Errorf("failed to render base prompt %q: %w", basePrompt.Name, err)
+	}
 
-	// Create the complete prompt by replacing placeholders
-	prompt := promptData.BasePrompt
-	prompt = strings.ReplaceAll(prompt, "{USER_DESCRIPTION}", userDescription)
-	prompt = strings.ReplaceAll(prompt, "{BACKGROUND}", background)
-	prompt = strings.ReplaceAll(prompt, "{EMOTION}", emotion)
-	prompt = strings.ReplaceAll(prompt, "{ACTION_OR_SIGN}", actionOrSign)
-	prompt = strings.ReplaceAll(prompt, "{GOLDEN_SPECIAL}", goldenSpecial)
+	slog.InfoContext(ctx, "Generated prompt", "base_prompt", basePrompt.Name, "background", background, "emotion", emotion, "action_or_sign", actionOrSign,
+		"event", event.EventType, "tier", event.UserTier, "months", event.Months, "event_modifiers", len(eventModifiers), "rarity", rarity.Name)
 
-	log.Printf("Generated prompt: Background=%s, Emotion=%s, Action/Sign=%s, Golden=%t", 
-	background, emotion, actionOrSign, goldenSpecial != "")
+	generated := GeneratedPrompt{
+		Text:           prompt,
+		Background:     background,
+		Emotion:        emotion,
+		ActionOrSign:   actionOrSign,
+		EventModifiers: eventModifiers,
+		Rarity:         rarity.Name,
+		BasePrompt:     basePrompt.Name,
+	}
+
+	if isSign {
+		generated.RequiredFeatures = []string{featureTextRendering}
+	}
 
-	return prompt
+	return generated, nil
 }
@@ -0,0 +1,285 @@
+// this module implements the dlq command used to inspect the messages that failed processing
+// and to send them back to the main queue once the cause of the failure is fixed
+//
+//	genImage [-queue sqs|spool] dlq list    [-reason text] [-user id|name]
+//	genImage [-queue sqs|spool] dlq show    <message id>
+//	genImage [-queue sqs|spool] dlq redrive [-reason text] [-user id|name] [-id id,...] [-all] [-dry-run]
+//	genImage [-queue sqs|spool] dlq purge   [-reason text] [-user id|name] [-id id,...] [-all] [-dry-run]
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// dlqReceiveWaitTime is how long the command waits for more DLQ messages before assuming it read them all
+	dlqReceiveWaitTime = 2 * time.Second
+	// sourceMessageGroupID is the message group used by the events tracker for the main queue
+	sourceMessageGroupID = "subvision"
+)
+
+// dlqFilter selects DLQ messages
+type dlqFilter struct {
+	reason string
+	user   string
+	ids    map[string]bool
+}
+
+// matches reports whether the message satisfies every filter that is set
+func (f dlqFilter) matches(message *Message) bool {
+	if len(f.ids) > 0 && !f.ids[message.ID] && !f.ids[originalMessageID(message)] {
+		return false
+	}
+
+	if f.reason != "" && !strings.Contains(strings.ToLower(message.Attributes[failureReasonAttribute]), strings.ToLower(f.reason)) {
+		return false
+	}
+
+	if f.user != "" {
+		var payload MessagePayload
+		if err := json.Unmarshal([]byte(message.Body), &payload); err != nil {
+			return false
+		}
+		if f.user != strconv.Itoa(payload.UserID) && !strings.EqualFold(f.user, payload.Username) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// empty reports whether no filter is set
+func (f dlqFilter) empty() bool {
+	return f.reason == "" && f.user == "" && len(f.ids) == 0
+}
+
+// runDLQCommand runs a dlq subcommand and returns the process exit code
+func runDLQCommand(queues Queues, args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(out, "usage: genImage dlq list|show|redrive|purge [flags]")
+		return 2
+	}
+
+	if q, ok := queues.DLQ.(interface{ SetWaitTime(time.Duration) }); ok {
+		q.SetWaitTime(dlqReceiveWaitTime)
+	}
+
+	command, args := args[0], args[1:]
+
+	flags := flag.NewFlagSet("dlq "+command, flag.ContinueOnError)
+	flags.SetOutput(out)
+	reason := flags.String("reason", "", "only messages whose failure reason contains this text")
+	user := flags.String("user", "", "only messages of this user ID or username")
+	ids := flags.String("id", "", "comma separated message IDs or original message IDs")
+	all := flags.Bool("all", false, "act on every message when no filter is set")
+	dryRun := flags.Bool("dry-run", false, "only print the messages that would be affected")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	filter := dlqFilter{reason: *reason, user: *user, ids: make(map[string]bool)}
+	for _, id := range strings.Split(*ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			filter.ids[id] = true
+		}
+	}
+
+	switch command {
+	case "list":
+		return dlqList(queues, filter, out)
+	case "show":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(out, "usage: genImage dlq show <message id>")
+			return 2
+		}
+		return dlqShow(queues, flags.Arg(0), out)
+	case "redrive", "purge":
+		if filter.empty() && !*all {
+			fmt.Fprintf(out, "refusing to %s the whole DLQ without -all\n", command)
+			return 2
+		}
+		return dlqApply(queues, command, filter, *dryRun, out)
+	default:
+		fmt.Fprintf(out, "unknown dlq command %q\n", command)
+		return 2
+	}
+}
+
+// readDLQ receives every message currently in the DLQ. The messages stay hidden until they are
+// acknowledged or released with releaseMessages.
+func readDLQ(dlq MessageSource) ([]*Message, error) {
+	var messages []*Message
+	seen := make(map[string]bool)
+
+	for {
+		batch, err := dlq.Receive(context.Background(), maxReceiveBatch)
+		if err != nil {
+			releaseMessages(dlq, messages)
+			return nil, fmt.Errorf("failed to receive DLQ messages: %w", err)
+		}
+		if len(batch) == 0 {
+			return messages, nil
+		}
+
+		for _, message := range batch {
+			// a message is received again if reading takes longer than its visibility timeout
+			if seen[message.ID] {
+				continue
+			}
+			seen[message.ID] = true
+			messages = append(messages, message)
+		}
+	}
+}
+
+// releaseMessages makes the messages visible again in the queue
+func releaseMessages(source MessageSource, messages []*Message) {
+	for _, message := range messages {
+		if err := source.Nack(context.Background(), message); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to release message %s: %v\n", message.ID, err)
+		}
+	}
+}
+
+// dlqList prints a summary of the DLQ messages matching the filter
+func dlqList(queues Queues, filter dlqFilter, out io.Writer) int {
+	messages, err := readDLQ(queues.DLQ)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	defer releaseMessages(queues.DLQ, messages)
+
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "MESSAGE ID\tORIGINAL ID\tUSER ID\tUSERNAME\tEVENT\tDATETIME\tREASON")
+
+	matched := 0
+	for _, message := range messages {
+		if !filter.matches(message) {
+			continue
+		}
+		matched++
+
+		var payload MessagePayload
+		_ = json.Unmarshal([]byte(message.Body), &payload)
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			message.ID, originalMessageID(message), payload.UserID, payload.Username,
+			payload.Event.EventType, payload.Datetime, message.Attributes[failureReasonAttribute])
+	}
+	writer.Flush()
+
+	fmt.Fprintf(out, "%d of %d messages\n", matched, len(messages))
+	return 0
+}
+
+// dlqShow prints the attributes and the body of a single DLQ message
+func dlqShow(queues Queues, id string, out io.Writer) int {
+	messages, err := readDLQ(queues.DLQ)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	defer releaseMessages(queues.DLQ, messages)
+
+	filter := dlqFilter{ids: map[string]bool{id: true}}
+	for _, message := range messages {
+		if !filter.matches(message) {
+			continue
+		}
+
+		fmt.Fprintf(out, "Message ID: %s\n", message.ID)
+		for name, value := range message.Attributes {
+			fmt.Fprintf(out, "%s: %s\n", name, value)
+		}
+
+		var body bytes.Buffer
+		if err := json.Indent(&body, []byte(message.Body), "", "  "); err != nil {
+			body.Reset()
+			body.WriteString(message.Body)
+		}
+		fmt.Fprintf(out, "\n%s\n", body.String())
+		return 0
+	}
+
+	fmt.Fprintf(out, "message %s not found in the DLQ\n", id)
+	return 1
+}
+
+// dlqApply redrives or purges the DLQ messages matching the filter
+func dlqApply(queues Queues, command string, filter dlqFilter, dryRun bool, out io.Writer) int {
+	messages, err := readDLQ(queues.DLQ)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	var untouched []*Message
+	defer func() { releaseMessages(queues.DLQ, untouched) }()
+
+	done, failed := 0, 0
+	for _, message := range messages {
+		if !filter.matches(message) {
+			untouched = append(untouched, message)
+			continue
+		}
+		if dryRun {
+			fmt.Fprintf(out, "would %s %s (%s)\n", command, message.ID, message.Attributes[failureReasonAttribute])
+			untouched = append(untouched, message)
+			continue
+		}
+
+		if command == "redrive" {
+			// a fresh deduplication ID, the original one could still be in the FIFO deduplication window
+			err = queues.Retry.Publish(OutgoingMessage{
+				Body:            message.Body,
+				GroupID:         sourceMessageGroupID,
+				DeduplicationID: uuid.NewString(),
+				Attributes: map[string]string{
+					originalMessageIDAttribute: originalMessageID(message),
+				},
+			})
+			if err != nil {
+				fmt.Fprintf(out, "failed to redrive %s: %v\n", message.ID, err)
+				untouched = append(untouched, message)
+				failed++
+				continue
+			}
+		}
+
+		if err := queues.DLQ.Ack(context.Background(), message); err != nil {
+			fmt.Fprintf(out, "failed to delete %s from the DLQ: %v\n", message.ID, err)
+			failed++
+			continue
+		}
+
+		fmt.Fprintf(out, "%s %s\n", pastTense(command), message.ID)
+		done++
+	}
+
+	fmt.Fprintf(out, "%d messages %s, %d failed\n", done, pastTense(command), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// pastTense returns the past tense of a dlq command for the output
+func pastTense(command string) string {
+	if command == "redrive" {
+		return "redriven"
+	}
+	return command + "d"
+}
@@ -0,0 +1,91 @@
+// this module generates the images with Imagen through the Gemini API,
+// so the images keep coming when Runware is down or out of balance
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/genai"
+)
+
+const geminiProviderName = "gemini"
+
+// GeminiProvider is an ImageProvider using the Imagen models of the Gemini API
+type GeminiProvider struct {
+	client *genai.Client
+}
+
+// NewGeminiProvider creates the Gemini client authenticated with the API key
+func NewGeminiProvider(ctx context.Context, apiKey string) (*GeminiProvider, error) {
+	client, err := genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey:  apiKey,
+		Backend: genai.BackendGeminiAPI,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+	return &GeminiProvider{client: client}, nil
+}
+
+// Name returns the name of the provider
+func (p *GeminiProvider) Name() string {
+	return geminiProviderName
+}
+
+// Generate asks Imagen to generate the image, which is returned directly in the response
+func (p *GeminiProvider) Generate(ctx context.Context, request ImageRequest) (*GeneratedImage, error) {
+	model := request.Model
+
+	numberOfImages := int64(1)
+	generateConfig := &genai.GenerateImagesConfig{
+		NumberOfImages: &numberOfImages,
+		AspectRatio:    model.AspectRatio,
+		// the subjects are the viewers, so the images are about people
+		PersonGeneration: genai.PersonGenerationAllowAdult,
+		// tells why an image is filtered out, instead of an empty response
+		IncludeRAIReason: true,
+	}
+	if model.CFGScale > 0 {
+		generateConfig.GuidanceScale = &model.CFGScale
+	}
+
+	result, err := p.client.Models.GenerateImages(ctx, model.ID, request.Prompt.Text, generateConfig)
+	if err != nil {
+		return nil, classifyGeminiError(fmt.Errorf("gemini API error: %w", err))
+	}
+
+	if len(result.GeneratedImages) == 0 || result.GeneratedImages[0] == nil {
+		return nil, fmt.Errorf("no image found in Gemini response")
+	}
+	generated := result.GeneratedImages[0]
+	if generated.Image == nil || len(generated.Image.ImageBytes) == 0 {
+		// the prompt would be filtered again, but a fallback model may accept it
+		return nil, permanentError(fmt.Errorf("gemini filtered out the image: %s", generated.RAIFilteredReason))
+	}
+
+	format, err := imageFormat(generated.Image.ImageBytes)
+	if err != nil {
+		return nil, permanentError(fmt.Errorf("gemini returned an invalid image: %w", err))
+	}
+
+	return &GeneratedImage{
+		Data:     generated.Image.ImageBytes,
+		Format:   format,
+		Provider: geminiProviderName,
+		Model:    model.ID,
+	}, nil
+}
+
+// classifyGeminiError classifies the errors of the genai SDK like the HTTP errors of Runware
+func classifyGeminiError(err error) error {
+	var clientErr genai.ClientError
+	if errors.As(err, &clientErr) {
+		return httpStatusError(clientErr.Code, "%w", err)
+	}
+
+	// server errors, network errors and timeouts
+	return transientError(err)
+}
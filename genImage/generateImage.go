@@ -1,174 +1,124 @@
-// this module uses runware API to generate images and save them to local disk
-// the function GenerateImage returns the image path, in case of error an error is also returned
+// this module generates the images with the image provider and saves them to the image store
+// the function GenerateImage returns the keys of the image and its thumbnail in the store,
+// in case of error an error is also returned
 
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
-	"math/rand"
-	"net/http"
-	"os"
-	"path/filepath"
+	"log/slog"
+	"strings"
 	"time"
-
-	"genImage/config"
-	"github.com/google/uuid"
 )
 
-// ModelsConfig represents the structure of the models JSON file
-type ModelsConfig struct {
-	Models []string `json:"models"`
+// GenerationResult is a generated image saved to the store
+type GenerationResult struct {
+	// ImagePath and ThumbnailPath are the keys in the store, ThumbnailPath is empty without thumbnails
+	ImagePath     string
+	ThumbnailPath string
+	// Generated is what the provider returned, Image is what was saved after post-processing
+	Generated *GeneratedImage
+	Image     Asset
 }
 
-// getRandomModel loads models from the JSON file and returns a randomly selected one
-func getRandomModel() (string, error) {
-	file, err := os.Open("models.json")
+// GenerateImage creates an image with the provider based on the provided prompt
+// and saves it to the store once post-processed. The model is picked by weight among the ones supporting
+// the required features, its fallbacks are tried if it fails. With more than one variation the variations
+// are composed into a grid, the ones that failed are left out. The key of the event is part of the file name,
+// so the images of events processed in the same second don't overwrite each other.
+func GenerateImage(ctx context.Context, provider ImageProvider, postProcessor *PostProcessor, store ImageStore, prompt GeneratedPrompt, username string, key string, variations int) (*GenerationResult, error) {
+	modelsConfig, err := loadModelsConfig("models.json")
 	if err != nil {
-		return "", fmt.Errorf("failed to open models.json: %w", err)
-	}
-	defer file.Close()
-
-	var config ModelsConfig
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
-		return "", fmt.Errorf("failed to decode models.json: %w", err)
-	}
-
-	if len(config.Models) == 0 {
-		return "", fmt.Errorf("no models found in models.json")
+		return nil, permanentError(fmt.Errorf("failed to load models: %w", err))
 	}
 
-	// Seed the random number generator with current time
-	rand.Seed(time.Now().UnixNano())
-
-	// Select a random model
-	randomIndex := rand.Intn(len(config.Models))
-	return config.Models[randomIndex], nil
-}
-
-// GenerateImage creates an image using the Runware API based on the provided prompt
-// and saves it to disk. Returns the path to the saved image or an error.
-func GenerateImage(prompt string, username string) (string, error) {
-	runwareSecrets := config.GetRunwareAPISecrets()
-
-	// Get a random model
-	randomModel, err := getRandomModel()
-	if err != nil {
-		return "", fmt.Errorf("failed to get random model: %w", err)
-	}
-
-	fmt.Printf("Using model: %s\n", randomModel)
-
-	// Prepare request payload
-	uuid := uuid.New()
-	payload := []map[string]interface{}{
-			{
-				"taskType":       "imageInference",
-				"taskUUID":       uuid,
-				"positivePrompt": prompt,
-				"model":          randomModel,
-				"numberResults":  1,
-			},
-		}
-
-	if randomModel == "google:4@1" {
-		payload = []map[string]interface{}{
-			{
-				"taskType":       "imageInference",
-				"taskUUID":       uuid,
-				"positivePrompt": prompt,
-				"model":          randomModel,
-				"numberResults":  1,
-			},
-		}
-	} else {
-		payload = []map[string]interface{}{
-			{
-				"taskType":       "imageInference",
-				"taskUUID":       uuid,
-				"positivePrompt": prompt,
-				"model":          randomModel,
-				"numberResults":  1,
-				"width":          1024,
-				"height":         1024,
-			},
+	var images []*GeneratedImage
+	for i := 0; i < max(variations, 1); i++ {
+		var generated *GeneratedImage
+		generated, err = generateWithModels(ctx, provider, modelsConfig, prompt, username)
+		if err != nil {
+			slog.WarnContext(ctx, "Variation failed", "variation", i, "error", err)
+			continue
 		}
+		images = append(images, generated)
 	}
-
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal payload: %w", err)
+	if len(images) == 0 {
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.runware.ai/v1", bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+	image := images[0]
+	if variations > 1 {
+		image, err = composeGrid(images)
+		if err != nil {
+			return nil, err
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+runwareSecrets.APIKey)
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
+	processed, err := postProcessor.Process(ctx, image, username)
 	if err != nil {
-		return "", fmt.Errorf("failed to call Runware API: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("runware API error: %s", string(body))
+		return nil, err
 	}
 
-	var apiResp struct {
-		Data []struct {
-			ImageURL string `json:"imageURL"`
-		} `json:"data"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
-		return "", fmt.Errorf("failed to decode Runware response: %w", err)
+	// Generate unique filename using timestamp and the event, a user can have several events in a second
+	timestamp := time.Now().Format("20060102_150405")
+	name := fmt.Sprintf("img_%s_%s_%s", username, timestamp, fileNameSafe(key))
+	result := &GenerationResult{
+		ImagePath: fmt.Sprintf("%s.%s", name, imageExtension(processed.Image.Format)),
+		Generated: image,
+		Image:     processed.Image,
+	}
+
+	// The thumbnail is saved first, so the image is never announced without it
+	if processed.Thumbnail != nil {
+		result.ThumbnailPath = fmt.Sprintf("%s_thumb.%s", name, imageExtension(processed.Thumbnail.Format))
+		if err := store.Put(ctx, result.ThumbnailPath, processed.Thumbnail.Data, "image/"+processed.Thumbnail.Format); err != nil {
+			return nil, err
+		}
 	}
 
-	if len(apiResp.Data) == 0 || apiResp.Data[0].ImageURL == "" {
-		return "", fmt.Errorf("no image URL found in Runware response")
+	if err := store.Put(ctx, result.ImagePath, processed.Image.Data, "image/"+processed.Image.Format); err != nil {
+		return nil, err
 	}
 
-	imageURL := apiResp.Data[0].ImageURL
-
-	// Download the image
-	imgResp, err := client.Get(imageURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to download image: %w", err)
-	}
-	defer imgResp.Body.Close()
-	if imgResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(imgResp.Body)
-		return "", fmt.Errorf("failed to download image, status: %d, body: %s", imgResp.StatusCode, string(body))
-	}
-
-	// Create output directory if it doesn't exist
-	outputDir := "../websiteOverlay/output_images"
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create output directory: %w", err)
-	}
+	return result, nil
+}
 
-	// Generate unique filename using timestamp
-	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("img_%s_%s.jpg", username, timestamp)
-	path := filepath.Join(outputDir, filename)
+// fileNameSafe replaces the characters that are not safe in file names and URLs, like the colons of the times
+func fileNameSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+}
 
-	// Save the image as jpg
-	outFile, err := os.Create(path)
-	if err != nil {
-		return "", fmt.Errorf("failed to create image file: %w", err)
+// generateWithModels generates an image with the first candidate model that succeeds
+func generateWithModels(ctx context.Context, provider ImageProvider, modelsConfig *ModelsConfig, prompt GeneratedPrompt, username string) (*GeneratedImage, error) {
+	var image *GeneratedImage
+	var err error
+	transient := false
+	for _, model := range modelsConfig.candidates(ctx, prompt.RequiredFeatures) {
+		slog.InfoContext(ctx, "Using model", "model", model.ID, "provider", model.providerName())
+
+		image, err = provider.Generate(ctx, ImageRequest{
+			Prompt:   prompt,
+			Username: username,
+			Model:    model,
+		})
+		if err == nil {
+			modelGenerations.WithLabelValues(model.providerName(), model.ID, "success").Inc()
+			return image, nil
+		}
+		modelGenerations.WithLabelValues(model.providerName(), model.ID, "failure").Inc()
+		slog.WarnContext(ctx, "Model failed", "model", model.ID, "error", err)
+		transient = transient || errorKind(err) == Transient
 	}
-	defer outFile.Close()
 
-	if _, err := io.Copy(outFile, imgResp.Body); err != nil {
-		return "", fmt.Errorf("failed to save image: %w", err)
+	// Retrying later makes sense if any of the candidates failed only temporarily
+	if transient {
+		return nil, transientError(err)
 	}
-
-	return filename, nil
+	return nil, err
 }
@@ -0,0 +1,187 @@
+// this module handles the gift bombs: a submysterygift is followed by one subgift event per gifted
+// subscription, those are coalesced into the image of the gifter. The gifter gets a single hero image
+// or a grid of several variations, depending on the policy and the number of gifted subscriptions.
+// The gift bombs are registered when their message is received, before the workers can process the
+// subgift events of the same batch, and saved in the gift bomb store so a restart doesn't forget them.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// GiftBombSettings configures the gift bomb policy
+type GiftBombSettings struct {
+	// Mode is hero for a single image, grid for a grid of variations, or auto to use the grid from GridMinQuantity
+	Mode            string `json:"mode"`
+	GridMinQuantity int    `json:"grid_min_quantity"`
+	// GridImages is the number of variations in the grid
+	GridImages int `json:"grid_images"`
+	// CoalesceWindowSeconds is how long after the submysterygift its subgift events are coalesced
+	CoalesceWindowSeconds int `json:"coalesce_window_seconds"`
+}
+
+// DefaultGiftBombSettings returns the policy used when settings.json doesn't configure it
+func DefaultGiftBombSettings() GiftBombSettings {
+	return GiftBombSettings{
+		Mode:                  "auto",
+		GridMinQuantity:       10,
+		GridImages:            4,
+		CoalesceWindowSeconds: 120,
+	}
+}
+
+// GiftBombPolicy applies the gift bomb settings and remembers the recent gift bombs of every gifter
+type GiftBombPolicy struct {
+	settings GiftBombSettings
+	// store keeps the gift bombs across restarts and instances
+	store GiftBombStore
+}
+
+// NewGiftBombPolicy validates the settings, the gift bombs are saved in the store
+func NewGiftBombPolicy(settings GiftBombSettings, store GiftBombStore) (*GiftBombPolicy, error) {
+	switch settings.Mode {
+	case "hero", "grid", "auto":
+	default:
+		return nil, fmt.Errorf("unsupported gift bomb mode %q, expected hero, grid or auto", settings.Mode)
+	}
+	if settings.Mode != "hero" && settings.GridImages < 2 {
+		return nil, fmt.Errorf("gift bomb grid_images must be at least 2")
+	}
+
+	return &GiftBombPolicy{
+		settings: settings,
+		store:    store,
+	}, nil
+}
+
+// Register remembers the gift bombs among the received messages. It is called before the messages are
+// handed to the workers, so the subgift events received with their submysterygift are coalesced.
+// The gift bombs over quota are not remembered: their image is skipped, so their subgift events get their own.
+func (g *GiftBombPolicy) Register(ctx context.Context, messages []*Message, quota *QuotaChecker) {
+	for _, message := range messages {
+		var payload MessagePayload
+		// the invalid messages are moved to the DLQ by their worker
+		if json.Unmarshal([]byte(message.Body), &payload) != nil || payload.Event.EventType != "submysterygift" {
+			continue
+		}
+		if reason := quota.Check(ctx, payload); reason != "" {
+			slog.InfoContext(ctx, "Gift bomb is over quota, its subgift events are not coalesced", "event_key", eventKey(payload), "reason", reason)
+			continue
+		}
+
+		bomb := GiftBombRecord{
+			GifterID:  payload.UserID,
+			EventKey:  eventKey(payload),
+			Remaining: giftQuantity(payload.Event),
+			ExpiresAt: time.Now().Add(time.Duration(g.settings.CoalesceWindowSeconds) * time.Second).Unix(),
+		}
+		// a redelivered submysterygift keeps the count of the subgift events already coalesced
+		if _, err := g.store.Register(ctx, bomb); err != nil {
+			// Its subgift events get their own image, which is better than none
+			slog.WarnContext(ctx, "Failed to save the gift bomb", "event_key", bomb.EventKey, "error", err)
+		}
+	}
+}
+
+// Cancel forgets the gift bomb of a submysterygift that is skipped after all, so its subgift events not
+// coalesced yet get their own image. The ones already coalesced are lost with the image of the gifter.
+func (g *GiftBombPolicy) Cancel(ctx context.Context, payload MessagePayload) {
+	if payload.Event.EventType != "submysterygift" {
+		return
+	}
+	if err := g.store.Cancel(ctx, payload.UserID, eventKey(payload)); err != nil {
+		slog.WarnContext(ctx, "Failed to cancel the gift bomb", "error", err)
+	}
+}
+
+// Coalesce returns why a subgift event is skipped, empty if the event is processed.
+// Twitch sends the subgift events right after their submysterygift, so they are matched by gifter and time,
+// up to the number of subscriptions gifted: the subgift events after them are single gifts with their own image.
+func (g *GiftBombPolicy) Coalesce(ctx context.Context, payload MessagePayload) string {
+	if payload.Event.EventType != "subgift" {
+		return ""
+	}
+
+	bomb, err := g.store.Claim(ctx, payload.UserID)
+	if err != nil {
+		// A duplicate image is better than none
+		slog.WarnContext(ctx, "Failed to read the gift bomb of the gifter", "error", err)
+		return ""
+	}
+	if bomb == "" {
+		return ""
+	}
+	return fmt.Sprintf("part of gift bomb %s", bomb)
+}
+
+// Variations returns the number of images to generate for the event, more than one for a grid
+func (g *GiftBombPolicy) Variations(event Event) int {
+	if event.EventType != "submysterygift" {
+		return 1
+	}
+
+	switch g.settings.Mode {
+	case "grid":
+		return g.settings.GridImages
+	case "auto":
+		if giftQuantity(event) >= g.settings.GridMinQuantity {
+			return g.settings.GridImages
+		}
+	}
+	return 1
+}
+
+// composeGrid lays the variations out on a grid, as square as possible, into a single PNG image
+func composeGrid(images []*GeneratedImage) (*GeneratedImage, error) {
+	tiles := make([]image.Image, len(images))
+	for i, generated := range images {
+		decoded, _, err := image.Decode(bytes.NewReader(generated.Data))
+		if err != nil {
+			return nil, permanentError(fmt.Errorf("failed to decode variation %d: %w", i, err))
+		}
+		tiles[i] = decoded
+	}
+
+	// every cell has the size of the first variation, the others are scaled to it
+	cell := tiles[0].Bounds()
+	columns := int(math.Ceil(math.Sqrt(float64(len(tiles)))))
+	rows := (len(tiles) + columns - 1) / columns
+	grid := image.NewRGBA(image.Rect(0, 0, columns*cell.Dx(), rows*cell.Dy()))
+	draw.Draw(grid, grid.Bounds(), image.NewUniform(color.RGBA{R: 16, G: 16, B: 24, A: 255}), image.Point{}, draw.Src)
+
+	var taskIDs []string
+	for i, tile := range tiles {
+		x, y := (i%columns)*cell.Dx(), (i/columns)*cell.Dy()
+		target := image.Rect(x, y, x+cell.Dx(), y+cell.Dy())
+		draw.CatmullRom.Scale(grid, target, tile, tile.Bounds(), draw.Src, nil)
+		if images[i].TaskID != "" {
+			taskIDs = append(taskIDs, images[i].TaskID)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, grid); err != nil {
+		return nil, permanentError(fmt.Errorf("failed to encode grid: %w", err))
+	}
+
+	return &GeneratedImage{
+		Data:     buf.Bytes(),
+		Format:   "png",
+		Provider: images[0].Provider,
+		Model:    images[0].Model,
+		TaskID:   strings.Join(taskIDs, ","),
+	}, nil
+}
@@ -0,0 +1,201 @@
+// this module keeps the gift bombs waiting for their subgift events, with the number of subgift events
+// still expected. They are shared by the instances and survive a restart, and they have their own table
+// as they are keyed by gifter while the processed events are keyed by event.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"genImage/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// giftBombTableName is the DynamoDB table holding the gift bombs, with gifterId as key and TTL on expiresAt
+const giftBombTableName = "GiftBombs"
+
+// GiftBombRecord is a submysterygift whose subgift events are still expected
+type GiftBombRecord struct {
+	GifterID int `json:"gifterId" dynamodbav:"gifterId"`
+	// EventKey is the event key of the submysterygift
+	EventKey string `json:"eventKey" dynamodbav:"eventKey"`
+	// Remaining is the number of subgift events still expected
+	Remaining int `json:"remaining" dynamodbav:"remaining"`
+	// ExpiresAt is the unix time the subgift events stop being coalesced, also used by the DynamoDB TTL
+	ExpiresAt int64 `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+// GiftBombStore keeps the gift bomb of every gifter, a gifter has at most one at a time
+type GiftBombStore interface {
+	// Register saves the gift bomb, replacing the previous one of the gifter. It returns false
+	// without changing anything if the same submysterygift is already saved and not expired.
+	Register(ctx context.Context, bomb GiftBombRecord) (bool, error)
+	// Claim counts a subgift event against the gift bomb of the gifter and returns the event key
+	// of the gift bomb, empty if the gifter has no gift bomb expecting more subgift events
+	Claim(ctx context.Context, gifterID int) (string, error)
+	// Cancel removes the gift bomb of the gifter if it is the one of the submysterygift with the event key
+	Cancel(ctx context.Context, gifterID int, eventKey string) error
+}
+
+// MemoryGiftBombStore is an in-process GiftBombStore, mostly useful for tests and local runs
+type MemoryGiftBombStore struct {
+	mu    sync.Mutex
+	bombs map[int]GiftBombRecord
+}
+
+// NewMemoryGiftBombStore returns an empty in-memory store
+func NewMemoryGiftBombStore() *MemoryGiftBombStore {
+	return &MemoryGiftBombStore{bombs: make(map[int]GiftBombRecord)}
+}
+
+// Register saves the gift bomb unless the same one is already saved
+func (s *MemoryGiftBombStore) Register(ctx context.Context, bomb GiftBombRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if saved, ok := s.bombs[bomb.GifterID]; ok && saved.EventKey == bomb.EventKey && time.Now().Unix() < saved.ExpiresAt {
+		return false, nil
+	}
+	s.bombs[bomb.GifterID] = bomb
+	return true, nil
+}
+
+// Claim counts a subgift event against the gift bomb of the gifter
+func (s *MemoryGiftBombStore) Claim(ctx context.Context, gifterID int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bomb, ok := s.bombs[gifterID]
+	if !ok || bomb.Remaining <= 0 || time.Now().Unix() >= bomb.ExpiresAt {
+		delete(s.bombs, gifterID)
+		return "", nil
+	}
+	bomb.Remaining--
+	s.bombs[gifterID] = bomb
+	return bomb.EventKey, nil
+}
+
+// Cancel removes the gift bomb if it is the one of the event key
+func (s *MemoryGiftBombStore) Cancel(ctx context.Context, gifterID int, eventKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bombs[gifterID].EventKey == eventKey {
+		delete(s.bombs, gifterID)
+	}
+	return nil
+}
+
+// DynamoGiftBombStore is a GiftBombStore backed by a DynamoDB table, the claims are atomic
+// so the instances processing the subgift events of a gift bomb don't coalesce more than were gifted
+type DynamoGiftBombStore struct {
+	client    *dynamodb.DynamoDB
+	tableName string
+}
+
+// NewDynamoGiftBombStore creates the DynamoDB client used by the store
+func NewDynamoGiftBombStore(awsSecrets config.AWSSecrets) (*DynamoGiftBombStore, error) {
+	sess, err := newAWSSession(awsSecrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+
+	return &DynamoGiftBombStore{
+		client:    dynamodb.New(sess),
+		tableName: giftBombTableName,
+	}, nil
+}
+
+// Register saves the gift bomb unless the same one is already saved
+func (s *DynamoGiftBombStore) Register(ctx context.Context, bomb GiftBombRecord) (bool, error) {
+	item, err := dynamodbattribute.MarshalMap(bomb)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal gift bomb: %w", err)
+	}
+
+	_, err = s.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+		// a redelivered submysterygift must not reset the subgift events already counted
+		ConditionExpression: aws.String("attribute_not_exists(gifterId) OR eventKey <> :eventKey OR expiresAt <= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":eventKey": {S: aws.String(bomb.EventKey)},
+			":now":      {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, classifyAWSError(fmt.Errorf("failed to put gift bomb to DynamoDB: %w", err))
+	}
+	return true, nil
+}
+
+// Claim counts a subgift event against the gift bomb of the gifter
+func (s *DynamoGiftBombStore) Claim(ctx context.Context, gifterID int) (string, error) {
+	result, err := s.client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"gifterId": {N: aws.String(strconv.Itoa(gifterID))},
+		},
+		UpdateExpression:    aws.String("SET remaining = remaining - :one"),
+		ConditionExpression: aws.String("remaining > :zero AND expiresAt > :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":  {N: aws.String("1")},
+			":zero": {N: aws.String("0")},
+			":now":  {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	// the gifter has no gift bomb, or it expired or got all its subgift events
+	if isConditionalCheckFailed(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", classifyAWSError(fmt.Errorf("failed to claim gift bomb in DynamoDB: %w", err))
+	}
+
+	var bomb GiftBombRecord
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &bomb); err != nil {
+		return "", fmt.Errorf("failed to unmarshal gift bomb: %w", err)
+	}
+	return bomb.EventKey, nil
+}
+
+// Cancel removes the gift bomb if it is the one of the event key
+func (s *DynamoGiftBombStore) Cancel(ctx context.Context, gifterID int, eventKey string) error {
+	_, err := s.client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"gifterId": {N: aws.String(strconv.Itoa(gifterID))},
+		},
+		// a newer gift bomb of the gifter is kept
+		ConditionExpression: aws.String("eventKey = :eventKey"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":eventKey": {S: aws.String(eventKey)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	if err != nil {
+		return classifyAWSError(fmt.Errorf("failed to delete gift bomb from DynamoDB: %w", err))
+	}
+	return nil
+}
+
+// isConditionalCheckFailed reports whether the write was refused by its condition
+func isConditionalCheckFailed(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+
+	"subvisionCore/history"
+)
+
+// giftPayload returns the payload of a gift event of the gifter
+func giftPayload(gifterID int, eventType string, quantity int, datetime string) MessagePayload {
+	return MessagePayload{
+		UserID:   gifterID,
+		Username: "gifter",
+		Datetime: datetime,
+		Event:    Event{EventType: eventType, Quantity: &quantity},
+	}
+}
+
+// giftMessage returns the queue message of the payload
+func giftMessage(t *testing.T, payload MessagePayload) *Message {
+	t.Helper()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+	return &Message{ID: eventKey(payload), Body: string(body)}
+}
+
+// noQuota returns a quota checker allowing every event
+func noQuota() *QuotaChecker {
+	return NewQuotaChecker(QuotaSettings{}, history.NewMemoryStore())
+}
+
+func TestGiftBombPolicyCoalesce(t *testing.T) {
+	bomb := giftPayload(1, "submysterygift", 2, "2024-05-01 20:00:00")
+	otherBomb := giftPayload(1, "submysterygift", 1, "2024-05-01 20:05:00")
+	subgift := giftPayload(1, "subgift", 1, "2024-05-01 20:00:01")
+
+	tests := []struct {
+		name string
+		// registered are the submysterygift events received, in batches
+		registered [][]MessagePayload
+		// events are coalesced in order, want is whether each one is skipped
+		events []MessagePayload
+		want   []bool
+	}{
+		{
+			name:   "subgift without gift bomb",
+			events: []MessagePayload{subgift},
+			want:   []bool{false},
+		},
+		{
+			name:       "subgift events up to the quantity are coalesced",
+			registered: [][]MessagePayload{{bomb}},
+			events:     []MessagePayload{subgift, subgift, subgift},
+			want:       []bool{true, true, false},
+		},
+		{
+			name:       "subgift events of another gifter are not coalesced",
+			registered: [][]MessagePayload{{bomb}},
+			events:     []MessagePayload{giftPayload(2, "subgift", 1, "2024-05-01 20:00:01")},
+			want:       []bool{false},
+		},
+		{
+			name:       "redelivered submysterygift doesn't reset the count",
+			registered: [][]MessagePayload{{bomb}, {bomb}},
+			events:     []MessagePayload{subgift, subgift, subgift},
+			want:       []bool{true, true, false},
+		},
+		{
+			name:       "new gift bomb replaces the previous one",
+			registered: [][]MessagePayload{{bomb}, {otherBomb}},
+			events:     []MessagePayload{subgift, subgift},
+			want:       []bool{true, false},
+		},
+		{
+			name:   "other events are never coalesced",
+			events: []MessagePayload{bomb, giftPayload(1, "sub", 0, "2024-05-01 20:00:01")},
+			want:   []bool{false, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewGiftBombPolicy(DefaultGiftBombSettings(), NewMemoryGiftBombStore())
+			if err != nil {
+				t.Fatalf("NewGiftBombPolicy() error = %v", err)
+			}
+			for _, batch := range tt.registered {
+				var messages []*Message
+				for _, payload := range batch {
+					messages = append(messages, giftMessage(t, payload))
+				}
+				policy.Register(context.Background(), messages, noQuota())
+			}
+
+			for i, event := range tt.events {
+				if got := policy.Coalesce(context.Background(), event) != ""; got != tt.want[i] {
+					t.Errorf("Coalesce() of event %d skipped = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGiftBombPolicyRegisterSurvivesRestart(t *testing.T) {
+	store := NewMemoryGiftBombStore()
+	before, _ := NewGiftBombPolicy(DefaultGiftBombSettings(), store)
+	before.Register(context.Background(), []*Message{giftMessage(t, giftPayload(1, "submysterygift", 2, "2024-05-01 20:00:00"))}, noQuota())
+	before.Coalesce(context.Background(), giftPayload(1, "subgift", 1, "2024-05-01 20:00:01"))
+
+	after, _ := NewGiftBombPolicy(DefaultGiftBombSettings(), store)
+	subgift := giftPayload(1, "subgift", 1, "2024-05-01 20:00:02")
+	if after.Coalesce(context.Background(), subgift) == "" {
+		t.Error("Coalesce() after a restart didn't coalesce the remaining subgift")
+	}
+	if after.Coalesce(context.Background(), subgift) != "" {
+		t.Error("Coalesce() after a restart coalesced more subgift events than were gifted")
+	}
+}
+
+func TestGiftBombPolicySkipsGiftBombsOverQuota(t *testing.T) {
+	// the gifter got an image 10 seconds ago
+	quota := newTestQuota(t, DefaultQuotaSettings(), 1, 10*time.Second)
+	policy, _ := NewGiftBombPolicy(DefaultGiftBombSettings(), NewMemoryGiftBombStore())
+	policy.Register(context.Background(), []*Message{giftMessage(t, giftPayload(1, "submysterygift", 2, "2024-05-01 20:00:00"))}, quota)
+
+	if reason := policy.Coalesce(context.Background(), giftPayload(1, "subgift", 1, "2024-05-01 20:00:01")); reason != "" {
+		t.Errorf("Coalesce() = %q into a gift bomb over quota, want the subgift event processed", reason)
+	}
+}
+
+func TestGiftBombPolicyCancel(t *testing.T) {
+	bomb := giftPayload(1, "submysterygift", 2, "2024-05-01 20:00:00")
+	subgift := giftPayload(1, "subgift", 1, "2024-05-01 20:00:01")
+
+	tests := []struct {
+		name     string
+		canceled MessagePayload
+		// want is whether the subgift event is still coalesced
+		want bool
+	}{
+		{name: "gift bomb canceled", canceled: bomb, want: false},
+		{name: "older submysterygift keeps the gift bomb", canceled: giftPayload(1, "submysterygift", 2, "2024-05-01 19:00:00"), want: true},
+		{name: "other events keep the gift bomb", canceled: giftPayload(1, "sub", 0, "2024-05-01 20:00:00"), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, _ := NewGiftBombPolicy(DefaultGiftBombSettings(), NewMemoryGiftBombStore())
+			policy.Register(context.Background(), []*Message{giftMessage(t, bomb)}, noQuota())
+
+			policy.Cancel(context.Background(), tt.canceled)
+			if got := policy.Coalesce(context.Background(), subgift) != ""; got != tt.want {
+				t.Errorf("Coalesce() after Cancel() skipped = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGiftBombPolicyIgnoresInvalidMessages(t *testing.T) {
+	store := NewMemoryGiftBombStore()
+	policy, _ := NewGiftBombPolicy(DefaultGiftBombSettings(), store)
+	policy.Register(context.Background(), []*Message{{ID: "invalid", Body: "{"}}, noQuota())
+
+	if len(store.bombs) != 0 {
+		t.Errorf("Register() of an invalid message saved %d gift bombs", len(store.bombs))
+	}
+}
+
+func TestGiftBombPolicyVariations(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings GiftBombSettings
+		event    Event
+		want     int
+	}{
+		{name: "hero", settings: GiftBombSettings{Mode: "hero"}, event: giftPayload(1, "submysterygift", 50, "").Event, want: 1},
+		{name: "grid", settings: GiftBombSettings{Mode: "grid", GridImages: 4}, event: giftPayload(1, "submysterygift", 1, "").Event, want: 4},
+		{name: "auto under the grid quantity", settings: DefaultGiftBombSettings(), event: giftPayload(1, "submysterygift", 9, "").Event, want: 1},
+		{name: "auto from the grid quantity", settings: DefaultGiftBombSettings(), event: giftPayload(1, "submysterygift", 10, "").Event, want: 4},
+		{name: "other events", settings: GiftBombSettings{Mode: "grid", GridImages: 4}, event: Event{EventType: "resub"}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewGiftBombPolicy(tt.settings, NewMemoryGiftBombStore())
+			if err != nil {
+				t.Fatalf("NewGiftBombPolicy() error = %v", err)
+			}
+			if got := policy.Variations(tt.event); got != tt.want {
+				t.Errorf("Variations() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewGiftBombPolicyRejectsInvalidSettings(t *testing.T) {
+	for _, settings := range []GiftBombSettings{{Mode: "mosaic"}, {Mode: "grid", GridImages: 1}} {
+		if _, err := NewGiftBombPolicy(settings, NewMemoryGiftBombStore()); err == nil {
+			t.Errorf("NewGiftBombPolicy(%+v) returned no error", settings)
+		}
+	}
+}
+
+func TestComposeGrid(t *testing.T) {
+	tests := []struct {
+		name       string
+		variations int
+		wantWidth  int
+		wantHeight int
+	}{
+		{name: "single image", variations: 1, wantWidth: 8, wantHeight: 8},
+		{name: "two images side by side", variations: 2, wantWidth: 16, wantHeight: 8},
+		{name: "four images in a square", variations: 4, wantWidth: 16, wantHeight: 16},
+		{name: "five images on three columns", variations: 5, wantWidth: 24, wantHeight: 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var images []*GeneratedImage
+			for i := 0; i < tt.variations; i++ {
+				images = append(images, &GeneratedImage{Data: solidPNG(t, 8, 8), Format: "png", Provider: "placeholder", TaskID: "task"})
+			}
+
+			grid, err := composeGrid(images)
+			if err != nil {
+				t.Fatalf("composeGrid() error = %v", err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(grid.Data))
+			if err != nil {
+				t.Fatalf("composeGrid() returned an invalid PNG: %v", err)
+			}
+			if got := decoded.Bounds(); got.Dx() != tt.wantWidth || got.Dy() != tt.wantHeight {
+				t.Errorf("grid size = %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.wantWidth, tt.wantHeight)
+			}
+			if grid.Provider != "placeholder" {
+				t.Errorf("grid provider = %q, want placeholder", grid.Provider)
+			}
+		})
+	}
+}
+
+func TestComposeGridRejectsInvalidImage(t *testing.T) {
+	_, err := composeGrid([]*GeneratedImage{{Data: []byte("not an image")}})
+	if err == nil || errorKind(err) != Permanent {
+		t.Errorf("composeGrid() error = %v, want a permanent error", err)
+	}
+}
+
+// solidPNG returns a PNG of the given size in a single color
+func solidPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
@@ -4,7 +4,22 @@ go 1.24.0
 
 require (
 	github.com/aws/aws-sdk-go v1.44.327
+	github.com/chai2010/webp v1.4.0
+	github.com/prometheus/client_golang v1.20.5
 	google.golang.org/genai v0.1.0
+	subvisionCore v0.0.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/text v0.29.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
 )
 
 require (
@@ -14,7 +29,10 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	golang.org/x/image v0.31.0 // indirect
+	golang.org/x/image v0.31.0
 	golang.org/x/oauth2 v0.23.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
 )
+
+// the core module is shared by the services of the repository
+replace subvisionCore => ../subvisionCore
@@ -0,0 +1,103 @@
+// this module runs the HTTP server used to monitor the service:
+// /healthz tells the process is alive, /readyz that it can process messages and /metrics serves the Prometheus metrics
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// readinessTimeout bounds the checks made for a /readyz request
+const readinessTimeout = 5 * time.Second
+
+// healthChecker is implemented by the queues that can check they are reachable
+type healthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// HealthServer serves the health, readiness and metrics endpoints
+type HealthServer struct {
+	pipeline *Pipeline
+	server   *http.Server
+}
+
+// NewHealthServer returns a server listening on addr once started
+func NewHealthServer(addr string, pipeline *Pipeline) *HealthServer {
+	s := &HealthServer{pipeline: pipeline}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	s.server = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// Start serves the endpoints in the background
+func (s *HealthServer) Start() {
+	go func() {
+		slog.Info("Health server listening", "addr", s.server.Addr)
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Health server failed", "error", err)
+		}
+	}()
+}
+
+// Close stops the server
+func (s *HealthServer) Close() error {
+	return s.server.Close()
+}
+
+// handleHealth answers as long as the process is running
+func (s *HealthServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReady checks the queue and the configuration, it answers 503 with the failed checks
+func (s *HealthServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	failures := s.readinessFailures(ctx)
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, failure := range failures {
+			fmt.Fprintln(w, failure)
+		}
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// readinessFailures returns why the service can't process messages, empty if it can
+func (s *HealthServer) readinessFailures(ctx context.Context) []string {
+	var failures []string
+
+	if checker, ok := s.pipeline.Queues.Source.(healthChecker); ok {
+		if err := checker.Check(ctx); err != nil {
+			failures = append(failures, fmt.Sprintf("queue: %v", err))
+		}
+	}
+
+	if len(promptData.BasePrompts) == 0 {
+		failures = append(failures, "prompt data: not loaded")
+	}
+
+	// models.json is read again for every generation, so a broken edit makes the service unable to generate
+	if _, err := loadModelsConfig("models.json"); err != nil {
+		failures = append(failures, fmt.Sprintf("models: %v", err))
+	}
+
+	return failures
+}
@@ -0,0 +1,27 @@
+// this module keeps the history of the images generated for every user, to know how many images
+// a supporter received and to show them their images. The store and its queries are in the core
+// module, so the websites query the history the same way.
+
+package main
+
+import (
+	"time"
+
+	"subvisionCore/history"
+)
+
+// newGeneratedImageRecord returns the record of an image just generated for the event
+func newGeneratedImageRecord(payload MessagePayload, rarity string, result *GenerationResult) history.Record {
+	return history.Record{
+		UserID:        payload.UserID,
+		CreatedAt:     history.FormatTime(time.Now()),
+		Username:      payload.Username,
+		ImagePath:     result.ImagePath,
+		ThumbnailPath: result.ThumbnailPath,
+		Rarity:        rarity,
+		EventType:     payload.Event.EventType,
+		EventKey:      eventKey(payload),
+		Provider:      result.Generated.Provider,
+		Model:         result.Generated.Model,
+	}
+}
@@ -0,0 +1,177 @@
+// this module remembers which events already produced an image, so a redelivered message
+// (visibility timeout, crash before the message was deleted) doesn't generate and bill a second image
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"genImage/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// idempotencyTableName is the DynamoDB table holding the processed events
+	idempotencyTableName = "ProcessedEvents"
+	// idempotencyTTL is how long a processed event is remembered
+	idempotencyTTL = 7 * 24 * time.Hour
+)
+
+// ProcessedEvent records the image produced for a source event
+type ProcessedEvent struct {
+	EventKey      string `json:"eventKey" dynamodbav:"eventKey"`
+	ImagePath     string `json:"imagePath" dynamodbav:"imagePath"`
+	ThumbnailPath string `json:"thumbnailPath" dynamodbav:"thumbnailPath"`
+	Rarity        string `json:"rarity" dynamodbav:"rarity"`
+	CreatedAt     string `json:"createdAt" dynamodbav:"createdAt"`
+	// SkipReason is set when the event was acknowledged without generating an image
+	SkipReason string `json:"skipReason,omitempty" dynamodbav:"skipReason,omitempty"`
+	// ExpiresAt is the unix time used by the DynamoDB TTL to delete the item
+	ExpiresAt int64 `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+// IdempotencyStore keeps track of the events that were already processed
+type IdempotencyStore interface {
+	// Get returns the processed event for the key, or nil if the event was not processed yet
+	Get(eventKey string) (*ProcessedEvent, error)
+	// Put records that the event produced the image
+	Put(event ProcessedEvent) error
+}
+
+// eventKey identifies the source event of a message, it is the same for every delivery of the event.
+// It is also used as deduplication ID so it only contains characters allowed by SQS.
+func eventKey(payload MessagePayload) string {
+	nBits := 0
+	if payload.Event.NBits != nil {
+		nBits = *payload.Event.NBits
+	}
+	datetime := strings.ReplaceAll(payload.Datetime, " ", "T")
+
+	return fmt.Sprintf("%d_%s_%s_%d_%d", payload.UserID, payload.Event.EventType, datetime, payload.Event.Months, nBits)
+}
+
+// newProcessedEvent returns the record for an image just produced for the event
+func newProcessedEvent(eventKey string, imagePath string, thumbnailPath string, rarity string) ProcessedEvent {
+	now := time.Now()
+	return ProcessedEvent{
+		EventKey:      eventKey,
+		ImagePath:     imagePath,
+		ThumbnailPath: thumbnailPath,
+		Rarity:        rarity,
+		CreatedAt:     now.Format("2006-01-02 15:04:05"),
+		ExpiresAt:     now.Add(idempotencyTTL).Unix(),
+	}
+}
+
+// newSkippedEvent returns the record for an event acknowledged without an image
+func newSkippedEvent(eventKey string, reason string) ProcessedEvent {
+	now := time.Now()
+	return ProcessedEvent{
+		EventKey:   eventKey,
+		SkipReason: reason,
+		CreatedAt:  now.Format("2006-01-02 15:04:05"),
+		ExpiresAt:  now.Add(idempotencyTTL).Unix(),
+	}
+}
+
+// MemoryIdempotencyStore is an in-process IdempotencyStore, mostly useful for tests and local runs
+type MemoryIdempotencyStore struct {
+	mu     sync.Mutex
+	events map[string]ProcessedEvent
+}
+
+// NewMemoryIdempotencyStore returns an empty in-memory store
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{events: make(map[string]ProcessedEvent)}
+}
+
+// Get returns the processed event for the key, or nil if it is unknown or expired
+func (s *MemoryIdempotencyStore) Get(eventKey string) (*ProcessedEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event, ok := s.events[eventKey]
+	if !ok || time.Now().Unix() > event.ExpiresAt {
+		return nil, nil
+	}
+	return &event, nil
+}
+
+// Put records the processed event
+func (s *MemoryIdempotencyStore) Put(event ProcessedEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events[event.EventKey] = event
+	return nil
+}
+
+// DynamoIdempotencyStore is an IdempotencyStore backed by a DynamoDB table with TTL on expiresAt
+type DynamoIdempotencyStore struct {
+	client    *dynamodb.DynamoDB
+	tableName string
+}
+
+// NewDynamoIdempotencyStore creates the DynamoDB client used by the store
+func NewDynamoIdempotencyStore(awsSecrets config.AWSSecrets) (*DynamoIdempotencyStore, error) {
+	sess, err := newAWSSession(awsSecrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+
+	return &DynamoIdempotencyStore{
+		client:    dynamodb.New(sess),
+		tableName: idempotencyTableName,
+	}, nil
+}
+
+// Get returns the processed event for the key, or nil if it is unknown or expired
+func (s *DynamoIdempotencyStore) Get(eventKey string) (*ProcessedEvent, error) {
+	result, err := s.client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"eventKey": {S: aws.String(eventKey)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, classifyAWSError(fmt.Errorf("failed to get processed event from DynamoDB: %w", err))
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var event ProcessedEvent
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &event); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal processed event: %w", err)
+	}
+
+	// the DynamoDB TTL deletes expired items only eventually
+	if time.Now().Unix() > event.ExpiresAt {
+		return nil, nil
+	}
+	return &event, nil
+}
+
+// Put records the processed event
+func (s *DynamoIdempotencyStore) Put(event ProcessedEvent) error {
+	item, err := dynamodbattribute.MarshalMap(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal processed event: %w", err)
+	}
+
+	_, err = s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return classifyAWSError(fmt.Errorf("failed to put processed event to DynamoDB: %w", err))
+	}
+	return nil
+}
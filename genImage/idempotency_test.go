@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestEventKey(t *testing.T) {
+	bits := 500
+
+	tests := []struct {
+		name    string
+		payload MessagePayload
+		want    string
+	}{
+		{
+			name: "sub",
+			payload: MessagePayload{
+				UserID:   42,
+				Username: "alice",
+				Datetime: "2024-05-01 20:15:00",
+				Event:    Event{EventType: "resub", Months: 7},
+			},
+			want: "42_resub_2024-05-01T20:15:00_7_0",
+		},
+		{
+			name: "cheer",
+			payload: MessagePayload{
+				UserID:   42,
+				Datetime: "2024-05-01 20:15:00",
+				Event:    Event{EventType: "bits", NBits: &bits},
+			},
+			want: "42_bits_2024-05-01T20:15:00_0_500",
+		},
+		{
+			name: "username is not part of the key",
+			payload: MessagePayload{
+				UserID:   42,
+				Username: "renamed",
+				Datetime: "2024-05-01 20:15:00",
+				Event:    Event{EventType: "resub", Months: 7},
+			},
+			want: "42_resub_2024-05-01T20:15:00_7_0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := eventKey(tt.payload); got != tt.want {
+				t.Errorf("eventKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// this module writes a JSON sidecar for every image with what was used to generate it,
+// so the generations can be searched later by the catalog command. The sidecars hold the private
+// descriptions of the users, so they go to the catalog store, never to the public image store.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metadataSuffix is appended to the image key to get the key of its sidecar
+const metadataSuffix = ".json"
+
+// DefaultCatalogSettings returns the catalog store used when settings.json doesn't configure it,
+// a directory that is not served by the overlay
+func DefaultCatalogSettings() StorageSettings {
+	return StorageSettings{
+		Backend: "local",
+		Local: LocalStorageSettings{
+			Dir: "image_metadata",
+		},
+		S3: S3StorageSettings{
+			URLExpirySeconds: 3600,
+		},
+	}
+}
+
+// ImageMetadata describes a generated image
+type ImageMetadata struct {
+	ImagePath     string `json:"image_path"`
+	ThumbnailPath string `json:"thumbnail_path,omitempty"`
+	CreatedAt     string `json:"created_at"`
+
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Event     Event  `json:"event"`
+	EventKey  string `json:"event_key"`
+	MessageID string `json:"message_id"`
+
+	Prompt         string   `json:"prompt"`
+	BasePrompt     string   `json:"base_prompt"`
+	Background     string   `json:"background"`
+	Emotion        string   `json:"emotion"`
+	ActionOrSign   string   `json:"action_or_sign"`
+	EventModifiers []string `json:"event_modifiers"`
+	Rarity         string   `json:"rarity"`
+
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	TaskID   string `json:"task_id,omitempty"`
+	// Format, Width and Height are the ones of the stored image, after post-processing
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// newImageMetadata collects the metadata of an image just generated for the message
+func newImageMetadata(message *Message, payload MessagePayload, prompt GeneratedPrompt, result *GenerationResult) ImageMetadata {
+	return ImageMetadata{
+		ImagePath:      result.ImagePath,
+		ThumbnailPath:  result.ThumbnailPath,
+		CreatedAt:      time.Now().UTC().Format(time.RFC3339),
+		UserID:         payload.UserID,
+		Username:       payload.Username,
+		Event:          payload.Event,
+		EventKey:       eventKey(payload),
+		MessageID:      originalMessageID(message),
+		Prompt:         prompt.Text,
+		BasePrompt:     prompt.BasePrompt,
+		Background:     prompt.Background,
+		Emotion:        prompt.Emotion,
+		ActionOrSign:   prompt.ActionOrSign,
+		EventModifiers: prompt.EventModifiers,
+		Rarity:         prompt.Rarity,
+		Provider:       result.Generated.Provider,
+		Model:          result.Generated.Model,
+		TaskID:         result.Generated.TaskID,
+		Format:         result.Image.Format,
+		Width:          result.Image.Width,
+		Height:         result.Image.Height,
+	}
+}
+
+// createdAt returns the time the image was generated
+func (m ImageMetadata) createdAt() time.Time {
+	createdAt, _ := time.Parse(time.RFC3339, m.CreatedAt)
+	return createdAt
+}
+
+// saveImageMetadata writes the sidecar of the image to the catalog store
+func saveImageMetadata(ctx context.Context, catalog ImageStore, metadata ImageMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image metadata: %w", err)
+	}
+
+	if err := catalog.Put(ctx, metadata.ImagePath+metadataSuffix, data, "application/json"); err != nil {
+		return fmt.Errorf("failed to save image metadata: %w", err)
+	}
+	return nil
+}
+
+// loadImageMetadata reads every sidecar of the catalog store, the oldest image first
+func loadImageMetadata(ctx context.Context, store ImageStore) ([]ImageMetadata, error) {
+	keys, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var catalog []ImageMetadata
+	for _, key := range keys {
+		if !strings.HasSuffix(key, metadataSuffix) {
+			continue
+		}
+
+		data, err := store.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		var metadata ImageMetadata
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			// a broken sidecar shouldn't hide all the others
+			slog.WarnContext(ctx, "Skipping invalid image metadata", "key", key, "error", err)
+			continue
+		}
+		catalog = append(catalog, metadata)
+	}
+
+	sort.Slice(catalog, func(i, j int) bool {
+		return catalog[i].CreatedAt < catalog[j].CreatedAt
+	})
+	return catalog, nil
+}
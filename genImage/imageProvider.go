@@ -0,0 +1,114 @@
+// this module defines the interface of the services generating the images,
+// so the pipeline doesn't depend on a specific API and can run offline with the placeholder provider
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// ImageRequest is what a provider needs to generate an image
+type ImageRequest struct {
+	Prompt   GeneratedPrompt
+	Username string
+	// Model is the models.json entry with the parameters of the generation
+	Model *ModelConfig
+}
+
+// GeneratedImage is an image returned by a provider, with the metadata of its generation
+type GeneratedImage struct {
+	Data []byte
+	// Format is the image format, like png or jpeg
+	Format   string
+	Provider string
+	Model    string
+	// TaskID identifies the generation at the provider, empty if the provider has none
+	TaskID string
+}
+
+// ImageProvider generates images from prompts
+type ImageProvider interface {
+	// Name identifies the provider in the logs and in the image metadata
+	Name() string
+	// Generate generates the image, errors are classified as transient or permanent
+	Generate(ctx context.Context, request ImageRequest) (*GeneratedImage, error)
+}
+
+// imageFormat returns the format of the image data, like png or jpeg
+func imageFormat(data []byte) (string, error) {
+	switch contentType := http.DetectContentType(data); contentType {
+	case "image/png":
+		return "png", nil
+	case "image/jpeg":
+		return "jpeg", nil
+	case "image/webp":
+		return "webp", nil
+	default:
+		return "", fmt.Errorf("unsupported image content type %s", contentType)
+	}
+}
+
+// imageExtension returns the file extension used for the format
+func imageExtension(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+// ProviderRouter is an ImageProvider sending each request to the provider of its models.json entry
+type ProviderRouter struct {
+	providers map[string]ImageProvider
+}
+
+// NewProviderRouter returns a router to the given providers
+func NewProviderRouter(providers ...ImageProvider) *ProviderRouter {
+	router := &ProviderRouter{providers: make(map[string]ImageProvider)}
+	for _, provider := range providers {
+		router.providers[provider.Name()] = provider
+	}
+	return router
+}
+
+// Name returns the name of the router, the generated images carry the name of the provider used
+func (r *ProviderRouter) Name() string {
+	return "models"
+}
+
+// Generate generates the image with the provider of the model
+func (r *ProviderRouter) Generate(ctx context.Context, request ImageRequest) (*GeneratedImage, error) {
+	name := request.Model.providerName()
+	provider, ok := r.providers[name]
+	if !ok {
+		// the next candidate may use a provider that is configured
+		return nil, permanentError(fmt.Errorf("image provider %s of model %s is not configured", name, request.Model.ID))
+	}
+	return provider.Generate(ctx, request)
+}
+
+// newImageProvider creates the image provider with the given name, models uses the provider set for each model
+func newImageProvider(name string, runwareAPIKey string, googleAPIKey string) (ImageProvider, error) {
+	switch name {
+	case "models":
+		providers := []ImageProvider{NewRunwareProvider(runwareAPIKey)}
+		gemini, err := NewGeminiProvider(context.Background(), googleAPIKey)
+		if err != nil {
+			// Runware alone still works, the models using Gemini fall back to their fallbacks
+			slog.Warn("Gemini models are disabled", "error", err)
+		} else {
+			providers = append(providers, gemini)
+		}
+		return NewProviderRouter(providers...), nil
+	case runwareProviderName:
+		return NewRunwareProvider(runwareAPIKey), nil
+	case geminiProviderName:
+		return NewGeminiProvider(context.Background(), googleAPIKey)
+	case placeholderProviderName:
+		return NewPlaceholderProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown image provider %q", name)
+	}
+}
@@ -0,0 +1,256 @@
+// this module stores the generated images and tells the URL they can be fetched from,
+// so genImage, the overlay and the Discord post don't need to share a disk
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"genImage/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ImageStore saves the images under a key, the file name of the image
+type ImageStore interface {
+	// Put saves the image
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get reads the image back
+	Get(ctx context.Context, key string) ([]byte, error)
+	// URL returns the URL the image can be fetched from
+	URL(key string) (string, error)
+	// List returns the keys of everything saved in the store
+	List(ctx context.Context) ([]string, error)
+}
+
+// StorageSettings selects and configures the image store
+type StorageSettings struct {
+	// Backend is local or s3
+	Backend string               `json:"backend"`
+	Local   LocalStorageSettings `json:"local"`
+	S3      S3StorageSettings    `json:"s3"`
+}
+
+// LocalStorageSettings configures the store writing to a directory
+type LocalStorageSettings struct {
+	Dir string `json:"dir"`
+	// BaseURL is where the directory is served, the overlay serves it on /output_images/
+	BaseURL string `json:"base_url"`
+}
+
+// S3StorageSettings configures the store writing to an S3 compatible bucket
+type S3StorageSettings struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	// Endpoint is set for S3 compatible services like MinIO, empty for AWS
+	Endpoint string `json:"endpoint"`
+	// Region overrides the region of the AWS secrets
+	Region string `json:"region"`
+	// PathStyle puts the bucket in the path instead of the host, which most S3 compatible services need
+	PathStyle bool `json:"path_style"`
+	// PublicBaseURL is where the bucket is publicly readable, if empty the URLs are presigned
+	PublicBaseURL string `json:"public_base_url"`
+	// URLExpirySeconds is how long a presigned URL is valid
+	URLExpirySeconds int `json:"url_expiry_seconds"`
+}
+
+// DefaultStorageSettings returns the storage used when settings.json doesn't configure it,
+// the directory served by the overlay running on the same host
+func DefaultStorageSettings() StorageSettings {
+	return StorageSettings{
+		Backend: "local",
+		Local: LocalStorageSettings{
+			Dir:     "../websiteOverlay/output_images",
+			BaseURL: "/output_images/",
+		},
+		S3: S3StorageSettings{
+			URLExpirySeconds: 3600,
+		},
+	}
+}
+
+// newImageStore creates the image store of the settings
+func newImageStore(settings StorageSettings, awsSecrets config.AWSSecrets) (ImageStore, error) {
+	switch settings.Backend {
+	case "local":
+		return NewLocalImageStore(settings.Local.Dir, settings.Local.BaseURL)
+	case "s3":
+		return NewS3ImageStore(settings.S3, awsSecrets)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", settings.Backend)
+	}
+}
+
+// LocalImageStore is an ImageStore writing to a local directory
+type LocalImageStore struct {
+	dir     string
+	baseURL string
+}
+
+// NewLocalImageStore creates the directory if it doesn't exist
+func NewLocalImageStore(dir string, baseURL string) (*LocalImageStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &LocalImageStore{dir: dir, baseURL: baseURL}, nil
+}
+
+// Put writes the image file
+func (s *LocalImageStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := os.WriteFile(filepath.Join(s.dir, key), data, 0644); err != nil {
+		return fmt.Errorf("failed to save image: %w", err)
+	}
+	return nil
+}
+
+// Get reads the image file
+func (s *LocalImageStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image file: %w", err)
+	}
+	return data, nil
+}
+
+// URL returns the URL of the image under the base URL
+func (s *LocalImageStore) URL(key string) (string, error) {
+	return s.baseURL + url.PathEscape(key), nil
+}
+
+// List returns the names of the files in the directory
+func (s *LocalImageStore) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list output directory: %w", err)
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			keys = append(keys, entry.Name())
+		}
+	}
+	return keys, nil
+}
+
+// S3ImageStore is an ImageStore writing to an S3 bucket, or to a bucket of an S3 compatible service
+type S3ImageStore struct {
+	client   *s3.S3
+	settings S3StorageSettings
+}
+
+// NewS3ImageStore creates the S3 client, with the AWS secrets as credentials
+func NewS3ImageStore(settings S3StorageSettings, awsSecrets config.AWSSecrets) (*S3ImageStore, error) {
+	if settings.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage needs a bucket")
+	}
+
+	region := awsSecrets.Region
+	if settings.Region != "" {
+		region = settings.Region
+	}
+	awsConfig := &aws.Config{
+		Region:           aws.String(region),
+		Credentials:      credentials.NewStaticCredentials(awsSecrets.AccessKeyID, awsSecrets.SecretAccessKey, ""),
+		S3ForcePathStyle: aws.Bool(settings.PathStyle),
+	}
+	if settings.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(settings.Endpoint)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+
+	if settings.URLExpirySeconds <= 0 {
+		settings.URLExpirySeconds = DefaultStorageSettings().S3.URLExpirySeconds
+	}
+	return &S3ImageStore{client: s3.New(sess), settings: settings}, nil
+}
+
+// objectKey returns the key of the object holding the image
+func (s *S3ImageStore) objectKey(key string) string {
+	return s.settings.Prefix + key
+}
+
+// Put uploads the image
+func (s *S3ImageStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.settings.Bucket),
+		Key:         aws.String(s.objectKey(key)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return classifyAWSError(fmt.Errorf("failed to upload image to S3: %w", err))
+	}
+	return nil
+}
+
+// Get downloads the image
+func (s *S3ImageStore) Get(ctx context.Context, key string) ([]byte, error) {
+	result, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.settings.Bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return nil, classifyAWSError(fmt.Errorf("failed to download image from S3: %w", err))
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, transientError(fmt.Errorf("failed to download image from S3: %w", err))
+	}
+	return data, nil
+}
+
+// URL returns the public URL of the image, or a presigned one if the bucket is not public
+func (s *S3ImageStore) URL(key string) (string, error) {
+	if s.settings.PublicBaseURL != "" {
+		return strings.TrimSuffix(s.settings.PublicBaseURL, "/") + "/" + s.settings.Prefix + url.PathEscape(key), nil
+	}
+
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.settings.Bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	signedURL, err := req.Presign(time.Duration(s.settings.URLExpirySeconds) * time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign image URL: %w", err)
+	}
+	return signedURL, nil
+}
+
+// List returns the keys of the objects under the prefix, without the prefix
+func (s *S3ImageStore) List(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.settings.Bucket),
+		Prefix: aws.String(s.settings.Prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(object.Key), s.settings.Prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, classifyAWSError(fmt.Errorf("failed to list S3 objects: %w", err))
+	}
+	return keys, nil
+}
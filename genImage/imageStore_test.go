@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"genImage/config"
+)
+
+// s3Object is an object saved in the stub S3 service
+type s3Object struct {
+	data        []byte
+	contentType string
+}
+
+// newS3Stub returns an S3 compatible service keeping the objects in memory, by path
+func newS3Stub(t *testing.T) (*httptest.Server, map[string]s3Object, *sync.Mutex) {
+	t.Helper()
+	var mu sync.Mutex
+	objects := make(map[string]s3Object)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = s3Object{data: data, contentType: r.Header.Get("Content-Type")}
+		case http.MethodGet:
+			object, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+				return
+			}
+			w.Header().Set("Content-Type", object.contentType)
+			w.Write(object.data)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, objects, &mu
+}
+
+// newTestS3Store returns a store of the bucket images on the endpoint
+func newTestS3Store(t *testing.T, endpoint string, settings S3StorageSettings) *S3ImageStore {
+	t.Helper()
+	settings.Bucket = "images"
+	settings.Endpoint = endpoint
+	settings.PathStyle = true
+	store, err := NewS3ImageStore(settings, config.AWSSecrets{Region: "eu-west-1", AccessKeyID: "key", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatalf("NewS3ImageStore() error = %v", err)
+	}
+	return store
+}
+
+func TestS3ImageStorePut(t *testing.T) {
+	server, objects, mu := newS3Stub(t)
+	store := newTestS3Store(t, server.URL, S3StorageSettings{Prefix: "subvision/"})
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "alice 1.png", []byte("png"), "image/png"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	mu.Lock()
+	object, ok := objects["/images/subvision/alice 1.png"]
+	mu.Unlock()
+	if !ok {
+		t.Fatalf("Put() saved %v, want the object under the prefix in the bucket", objects)
+	}
+	if string(object.data) != "png" || object.contentType != "image/png" {
+		t.Errorf("Put() saved %q with content type %q, want %q with %q", object.data, object.contentType, "png", "image/png")
+	}
+
+	data, err := store.Get(ctx, "alice 1.png")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(data) != "png" {
+		t.Errorf("Get() = %q, want %q", data, "png")
+	}
+	if _, err := store.Get(ctx, "missing.png"); errorKind(err) != Permanent {
+		t.Errorf("Get() of a missing image error = %v, want a permanent error", err)
+	}
+}
+
+func TestS3ImageStorePutDenied(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+	}))
+	t.Cleanup(server.Close)
+	store := newTestS3Store(t, server.URL, S3StorageSettings{})
+
+	err := store.Put(context.Background(), "alice.png", []byte("png"), "image/png")
+	if errorKind(err) != Permanent {
+		t.Errorf("Put() error = %v, want a permanent error", err)
+	}
+}
+
+func TestS3ImageStoreURL(t *testing.T) {
+	server, _, _ := newS3Stub(t)
+
+	tests := []struct {
+		name     string
+		settings S3StorageSettings
+		// wantPrefix is the start of the URL, wantQuery are parts of its query
+		wantPrefix string
+		wantQuery  []string
+	}{
+		{
+			name:       "public bucket",
+			settings:   S3StorageSettings{Prefix: "subvision/", PublicBaseURL: "https://cdn.example.com/"},
+			wantPrefix: "https://cdn.example.com/subvision/alice%201.png",
+		},
+		{
+			name:       "presigned",
+			settings:   S3StorageSettings{Prefix: "subvision/"},
+			wantPrefix: server.URL + "/images/subvision/alice%201.png?",
+			wantQuery:  []string{"X-Amz-Expires=3600", "X-Amz-Signature="},
+		},
+		{
+			name:       "presigned with expiry",
+			settings:   S3StorageSettings{URLExpirySeconds: 60},
+			wantPrefix: server.URL + "/images/alice%201.png?",
+			wantQuery:  []string{"X-Amz-Expires=60"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestS3Store(t, server.URL, tt.settings)
+
+			got, err := store.URL("alice 1.png")
+			if err != nil {
+				t.Fatalf("URL() error = %v", err)
+			}
+			if !strings.HasPrefix(got, tt.wantPrefix) {
+				t.Errorf("URL() = %q, want it to start with %q", got, tt.wantPrefix)
+			}
+			for _, part := range tt.wantQuery {
+				if !strings.Contains(got, part) {
+					t.Errorf("URL() = %q, want it to contain %q", got, part)
+				}
+			}
+		})
+	}
+}
+
+func TestS3ImageStorePresignedURLServesTheImage(t *testing.T) {
+	server, _, _ := newS3Stub(t)
+	store := newTestS3Store(t, server.URL, S3StorageSettings{Prefix: "subvision/"})
+	if err := store.Put(context.Background(), "alice.png", []byte("png"), "image/png"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	imageURL, err := store.URL("alice.png")
+	if err != nil {
+		t.Fatalf("URL() error = %v", err)
+	}
+	response, err := http.Get(imageURL)
+	if err != nil {
+		t.Fatalf("GET %s error = %v", imageURL, err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(data) != "png" {
+		t.Errorf("GET of the URL = %d %q, want 200 %q", response.StatusCode, data, "png")
+	}
+}
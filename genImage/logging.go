@@ -0,0 +1,106 @@
+// this module sets up the structured logging. Every message is processed as a job: the job ID is the SQS
+// message ID, followed by the Runware task UUID once the image is requested, and it is carried in the context
+// so every log line of the job can be filtered, e.g. with jq 'select(.job_id | startswith("..."))' in JSON mode.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// logContextKey is the context key of the logContext
+type logContextKey struct{}
+
+// logContext holds the attributes added to every log line made with the context
+type logContext struct {
+	messageID string
+	taskUUID  string
+	attrs     []slog.Attr
+}
+
+// jobID identifies the job, the message ID alone until the image is requested
+func (c *logContext) jobID() string {
+	if c.taskUUID == "" {
+		return c.messageID
+	}
+	return c.messageID + "/" + c.taskUUID
+}
+
+// currentLogContext returns a copy of the log context of ctx, so it can be extended without changing the parent
+func currentLogContext(ctx context.Context) logContext {
+	if c, ok := ctx.Value(logContextKey{}).(*logContext); ok {
+		copied := *c
+		copied.attrs = append([]slog.Attr(nil), c.attrs...)
+		return copied
+	}
+	return logContext{}
+}
+
+// withJob returns a context whose log lines belong to the job of the message
+func withJob(ctx context.Context, messageID string) context.Context {
+	c := currentLogContext(ctx)
+	c.messageID = messageID
+	return context.WithValue(ctx, logContextKey{}, &c)
+}
+
+// withTask adds the task UUID of the image request to the job ID
+func withTask(ctx context.Context, taskUUID string) context.Context {
+	c := currentLogContext(ctx)
+	c.taskUUID = taskUUID
+	return context.WithValue(ctx, logContextKey{}, &c)
+}
+
+// withLogAttrs returns a context whose log lines have the attributes, given as slog key-value pairs
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	c := currentLogContext(ctx)
+	c.attrs = append(c.attrs, slog.Group("", args...).Value.Group()...)
+	return context.WithValue(ctx, logContextKey{}, &c)
+}
+
+// contextHandler adds the job attributes of the context to the records
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle adds the attributes of the log context before handing the record over
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if c, ok := ctx.Value(logContextKey{}).(*logContext); ok {
+		if c.messageID != "" {
+			record.AddAttrs(slog.String("job_id", c.jobID()), slog.String("message_id", c.messageID))
+		}
+		if c.taskUUID != "" {
+			record.AddAttrs(slog.String("task_uuid", c.taskUUID))
+		}
+		record.AddAttrs(c.attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs keeps the context handler around the handler with the attributes
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps the context handler around the handler with the group
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogging makes the default logger, also used by the log package, write text or JSON lines to out
+func setupLogging(format string, out io.Writer) error {
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(out, nil)
+	case "json":
+		handler = slog.NewJSONHandler(out, nil)
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
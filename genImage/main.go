@@ -1,29 +1,238 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+
+	"genImage/config"
+
+	"subvisionCore/history"
 )
 
 func main() {
-	fmt.Println("Starting SubVision Image Generation Service...")
-	
-	// Set up logging
-	log.SetOutput(os.Stdout)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	
-	// Start SQS message processing in a separate goroutine
-	go ProcessSQSMessages()
-	
-	fmt.Println("Service started. Press CTRL+C to exit")
-	
+	queueBackend := flag.String("queue", "sqs", "queue backend: sqs, spool or memory (empty queues, lost on exit)")
+	spoolDir := flag.String("spool-dir", "spool", "directory used by the spool queue backend")
+	idempotencyBackend := flag.String("idempotency", "dynamodb", "processed events and gift bombs stores: dynamodb or memory")
+	historyBackend := flag.String("history", "dynamodb", "generated images history store: dynamodb or memory")
+	imageProvider := flag.String("provider", "models", "image provider: models (the provider set for each model in models.json), runware, gemini or placeholder (offline, no credits spent)")
+	logFormat := flag.String("log-format", "text", "log output: text or json (one object per line, filterable by job_id)")
+	healthAddr := flag.String("http", ":9090", "address of the /healthz, /readyz and /metrics endpoints, empty to disable them")
+	poolConfig := DefaultWorkerPoolConfig()
+	flag.IntVar(&poolConfig.Workers, "workers", poolConfig.Workers, "number of messages processed in parallel")
+	flag.DurationVar(&poolConfig.DrainTimeout, "drain-timeout", poolConfig.DrainTimeout, "how long in-flight messages can finish on shutdown before they are released")
+	descriptionTTL := flag.Duration("description-ttl", 0, "how long the user descriptions are cached, 0 to read them on every message so the updates are used right away")
+	flag.DurationVar(&poolConfig.HeartbeatInterval, "heartbeat", poolConfig.HeartbeatInterval, "how often the visibility of in-flight messages is extended")
+	flag.Parse()
+
+	// genImage dlq ... inspects and redrives the dead letter queue instead of running the service
+	if flag.NArg() > 0 && flag.Arg(0) == "dlq" {
+		queues, err := newQueues(*queueBackend, *spoolDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating queues: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(runDLQCommand(queues, flag.Args()[1:], os.Stdout))
+	}
+
+	// genImage catalog ... searches the generated images instead of running the service
+	if flag.NArg() > 0 && flag.Arg(0) == "catalog" {
+		settings, err := loadSettings("settings.json")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading settings: %v\n", err)
+			os.Exit(1)
+		}
+		catalog, err := newImageStore(settings.Catalog, config.GetAWSSecrets())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating catalog store: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(runCatalogCommand(catalog, flag.Args()[1:], os.Stdout))
+	}
+
+	// Set up logging, the log package writes through the same logger
+	if err := setupLogging(*logFormat, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	slog.Info("Starting SubVision Image Generation Service")
+
+	settings, err := loadSettings("settings.json")
+	if err != nil {
+		fatal("Error loading settings", err)
+	}
+
+	queues, err := newQueues(*queueBackend, *spoolDir)
+	if err != nil {
+		fatal("Error creating queues", err)
+	}
+
+	idempotency, err := newIdempotencyStore(*idempotencyBackend)
+	if err != nil {
+		fatal("Error creating idempotency store", err)
+	}
+
+	historyStore, err := newHistoryStore(*historyBackend)
+	if err != nil {
+		fatal("Error creating history store", err)
+	}
+
+	descriptions, err := newDescriptionRepository(config.GetAWSSecrets(), *descriptionTTL)
+	if err != nil {
+		fatal("Error creating description repository", err)
+	}
+
+	images, err := newImageProvider(*imageProvider, config.GetRunwareAPISecrets().APIKey, config.GetGoogleAPISecrets().APIKey)
+	if err != nil {
+		fatal("Error creating image provider", err)
+	}
+
+	postProcessor, err := NewPostProcessor(settings.PostProcess)
+	if err != nil {
+		fatal("Error creating post-processor", err)
+	}
+
+	giftBombStore, err := newGiftBombStore(*idempotencyBackend)
+	if err != nil {
+		fatal("Error creating gift bomb store", err)
+	}
+
+	giftBombs, err := NewGiftBombPolicy(settings.GiftBomb, giftBombStore)
+	if err != nil {
+		fatal("Error creating gift bomb policy", err)
+	}
+
+	store, err := newImageStore(settings.Storage, config.GetAWSSecrets())
+	if err != nil {
+		fatal("Error creating image store", err)
+	}
+
+	catalog, err := newImageStore(settings.Catalog, config.GetAWSSecrets())
+	if err != nil {
+		fatal("Error creating catalog store", err)
+	}
+
+	sinks, err := newSinks(settings.Sinks, settings.Discord, settings.Telegram, store)
+	if err != nil {
+		fatal("Error creating sinks", err)
+	}
+
+	telegramSecrets := config.GetTelegramSecrets()
+	notifier := newNotifier(settings.Telegram, telegramSecrets.BotToken, telegramSecrets.ChatID)
+
+	pipeline := &Pipeline{
+		Queues:       queues,
+		Retry:        settings.Retry,
+		Notifier:     notifier,
+		Idempotency:  idempotency,
+		History:      historyStore,
+		Descriptions: descriptions,
+		Quota:        NewQuotaChecker(settings.Quota, historyStore),
+		GiftBombs:    giftBombs,
+		Images:       images,
+		PostProcess:  postProcessor,
+		Store:        store,
+		Catalog:      catalog,
+		Sinks:        sinks,
+	}
+
+	var healthServer *HealthServer
+	if *healthAddr != "" {
+		healthServer = NewHealthServer(*healthAddr, pipeline)
+		healthServer.Start()
+	}
+
+	// The termination signal cancels the context, which stops the message processing
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Start message processing in a separate goroutine
+	processed := make(chan struct{})
+	go func() {
+		ProcessMessages(ctx, pipeline, poolConfig)
+		close(processed)
+	}()
+
+	slog.Info("Service started, press CTRL+C to exit")
+
 	// Wait for termination signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	
-	fmt.Println("Shutting down...")
+	<-ctx.Done()
+	// A second signal kills the service without waiting for the drain
+	stop()
+
+	slog.Info("Shutting down")
+	<-processed
+	notifier.Close()
+	if healthServer != nil {
+		healthServer.Close()
+	}
+}
+
+// newQueues creates the pipeline queues for the selected backend
+func newQueues(backend string, spoolDir string) (Queues, error) {
+	switch backend {
+	case "sqs":
+		return NewSQSQueues(config.GetAWSSecrets())
+	case "spool":
+		slog.Info("Using spool queues", "dir", spoolDir)
+		return NewSpoolQueues(spoolDir)
+	case "memory":
+		slog.Info("Using in-memory queues, the messages are lost on exit")
+		return NewMemoryQueues(), nil
+	default:
+		return Queues{}, fmt.Errorf("unknown queue backend %q", backend)
+	}
+}
+
+// newIdempotencyStore creates the processed events store for the selected backend
+func newIdempotencyStore(backend string) (IdempotencyStore, error) {
+	switch backend {
+	case "dynamodb":
+		return NewDynamoIdempotencyStore(config.GetAWSSecrets())
+	case "memory":
+		slog.Info("Using in-memory idempotency store, processed events are forgotten on restart")
+		return NewMemoryIdempotencyStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown idempotency backend %q", backend)
+	}
+}
+
+// newGiftBombStore creates the gift bomb store, it uses the backend of the processed events store
+func newGiftBombStore(backend string) (GiftBombStore, error) {
+	switch backend {
+	case "dynamodb":
+		return NewDynamoGiftBombStore(config.GetAWSSecrets())
+	case "memory":
+		return NewMemoryGiftBombStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown idempotency backend %q", backend)
+	}
+}
+
+// newHistoryStore creates the generated images history store for the selected backend
+func newHistoryStore(backend string) (history.Store, error) {
+	switch backend {
+	case "dynamodb":
+		sess, err := newAWSSession(config.GetAWSSecrets())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AWS session: %w", err)
+		}
+		return history.NewDynamoStore(sess), nil
+	case "memory":
+		slog.Info("Using in-memory history store, the history is lost on restart")
+		return history.NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown history backend %q", backend)
+	}
+}
+
+// fatal logs the error that prevents the service from starting and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,570 @@
+// this module abstracts the queues used by the pipeline so it can run against SQS,
+// an in-memory queue (tests) or a JSONL spool directory (local development)
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"genImage/config"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/google/uuid"
+)
+
+// Message is a message received from a MessageSource
+type Message struct {
+	ID            string
+	Body          string
+	ReceiptHandle string
+	Attributes    map[string]string
+}
+
+// OutgoingMessage is a message published to a MessageSink
+type OutgoingMessage struct {
+	Body            string
+	GroupID         string
+	DeduplicationID string
+	Attributes      map[string]string
+}
+
+// MessageSource is a queue the pipeline consumes messages from
+type MessageSource interface {
+	// Receive waits for up to max messages, it can return an empty slice
+	Receive(ctx context.Context, max int) ([]*Message, error)
+	// Ack removes a processed message from the queue
+	Ack(ctx context.Context, message *Message) error
+	// Nack makes the message immediately available for redelivery
+	Nack(ctx context.Context, message *Message) error
+	// ExtendVisibility hides the message from other consumers for the given duration from now
+	ExtendVisibility(ctx context.Context, message *Message, timeout time.Duration) error
+}
+
+// MessageSink is a queue the pipeline publishes messages to
+type MessageSink interface {
+	Publish(message OutgoingMessage) error
+}
+
+// MessageQueue is a queue that can be both consumed and published to
+type MessageQueue interface {
+	MessageSource
+	MessageSink
+}
+
+// Queues groups the queues used by the pipeline
+type Queues struct {
+	Source MessageSource
+	// Retry publishes to the same queue as Source, it is used to reschedule failed messages
+	Retry MessageSink
+	// DLQ is also consumed by the dlq command
+	DLQ         MessageQueue
+	ReadyImages MessageSink
+}
+
+const (
+	// receiveWaitTime is how long a Receive call waits for messages (long polling)
+	receiveWaitTime = 20 * time.Second
+	// defaultVisibilityTimeout is how long a received message stays hidden from other consumers
+	defaultVisibilityTimeout = 60 * time.Second
+)
+
+// ---------------------------------------------------------------- SQS
+
+// SQSQueue is a MessageSource and MessageSink backed by an SQS queue
+type SQSQueue struct {
+	client            *sqs.SQS
+	queueURL          string
+	waitTime          time.Duration
+	visibilityTimeout time.Duration
+}
+
+// NewSQSQueue returns a queue bound to the given SQS queue URL
+func NewSQSQueue(client *sqs.SQS, queueURL string) *SQSQueue {
+	return &SQSQueue{
+		client:            client,
+		queueURL:          queueURL,
+		waitTime:          receiveWaitTime,
+		visibilityTimeout: defaultVisibilityTimeout,
+	}
+}
+
+// NewSQSQueues builds the pipeline queues from the AWS configuration
+func NewSQSQueues(awsSecrets config.AWSSecrets) (Queues, error) {
+	sess, err := newAWSSession(awsSecrets)
+	if err != nil {
+		return Queues{}, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+
+	sqsClient := sqs.New(sess)
+	source := NewSQSQueue(sqsClient, awsSecrets.SubsToProcessSqsQueueURL)
+
+	return Queues{
+		Source:      source,
+		Retry:       source,
+		DLQ:         NewSQSQueue(sqsClient, awsSecrets.SubsToProcessSqsDlqQueueURL),
+		ReadyImages: NewSQSQueue(sqsClient, awsSecrets.ReadyImagesSqsQueueURL),
+	}, nil
+}
+
+// SetWaitTime changes how long Receive waits for messages
+func (q *SQSQueue) SetWaitTime(waitTime time.Duration) {
+	q.waitTime = waitTime
+}
+
+// Check reads an attribute of the queue to make sure it is reachable
+func (q *SQSQueue) Check(ctx context.Context) error {
+	_, err := q.client.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(q.queueURL),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+	})
+	return err
+}
+
+// Receive long polls the queue for messages
+func (q *SQSQueue) Receive(ctx context.Context, max int) ([]*Message, error) {
+	result, err := q.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(q.queueURL),
+		MaxNumberOfMessages:   aws.Int64(int64(max)),
+		WaitTimeSeconds:       aws.Int64(int64(q.waitTime / time.Second)),
+		VisibilityTimeout:     aws.Int64(int64(q.visibilityTimeout / time.Second)),
+		MessageAttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameAll}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, 0, len(result.Messages))
+	for _, m := range result.Messages {
+		attributes := make(map[string]string, len(m.MessageAttributes))
+		for name, value := range m.MessageAttributes {
+			if value.StringValue != nil {
+				attributes[name] = *value.StringValue
+			}
+		}
+		messages = append(messages, &Message{
+			ID:            aws.StringValue(m.MessageId),
+			Body:          aws.StringValue(m.Body),
+			ReceiptHandle: aws.StringValue(m.ReceiptHandle),
+			Attributes:    attributes,
+		})
+	}
+	return messages, nil
+}
+
+// Ack deletes the message from the queue
+func (q *SQSQueue) Ack(ctx context.Context, message *Message) error {
+	_, err := q.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.queueURL),
+		ReceiptHandle: aws.String(message.ReceiptHandle),
+	})
+	return err
+}
+
+// Nack sets the visibility timeout to zero so the message is redelivered
+func (q *SQSQueue) Nack(ctx context.Context, message *Message) error {
+	return q.ExtendVisibility(ctx, message, 0)
+}
+
+// ExtendVisibility changes the visibility timeout of an in-flight message
+func (q *SQSQueue) ExtendVisibility(ctx context.Context, message *Message, timeout time.Duration) error {
+	_, err := q.client.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.queueURL),
+		ReceiptHandle:     aws.String(message.ReceiptHandle),
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	})
+	return err
+}
+
+// Publish sends a message to the queue, group and deduplication IDs are only set if provided (FIFO queues)
+func (q *SQSQueue) Publish(message OutgoingMessage) error {
+	params := &sqs.SendMessageInput{
+		MessageBody: aws.String(message.Body),
+		QueueUrl:    aws.String(q.queueURL),
+	}
+	if message.GroupID != "" {
+		params.MessageGroupId = aws.String(message.GroupID)
+	}
+	if message.DeduplicationID != "" {
+		params.MessageDeduplicationId = aws.String(message.DeduplicationID)
+	}
+	if len(message.Attributes) > 0 {
+		params.MessageAttributes = make(map[string]*sqs.MessageAttributeValue, len(message.Attributes))
+		for name, value := range message.Attributes {
+			params.MessageAttributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+
+	_, err := q.client.SendMessage(params)
+	return err
+}
+
+// ---------------------------------------------------------------- in-memory
+
+// deduplicationWindow is how long a deduplication ID is remembered, same as SQS FIFO queues
+const deduplicationWindow = 5 * time.Minute
+
+type memoryEntry struct {
+	message        Message
+	invisibleUntil time.Time
+}
+
+// MemoryQueue is an in-process MessageSource and MessageSink, mostly useful for tests
+type MemoryQueue struct {
+	mu                sync.Mutex
+	entries           []*memoryEntry
+	deduplication     map[string]time.Time
+	notify            chan struct{}
+	waitTime          time.Duration
+	visibilityTimeout time.Duration
+}
+
+// NewMemoryQueue returns an empty in-memory queue
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{
+		deduplication:     make(map[string]time.Time),
+		notify:            make(chan struct{}, 1),
+		waitTime:          receiveWaitTime,
+		visibilityTimeout: defaultVisibilityTimeout,
+	}
+}
+
+// NewMemoryQueues returns pipeline queues that are all in memory
+func NewMemoryQueues() Queues {
+	source := NewMemoryQueue()
+	return Queues{
+		Source:      source,
+		Retry:       source,
+		DLQ:         NewMemoryQueue(),
+		ReadyImages: NewMemoryQueue(),
+	}
+}
+
+// Publish appends the message to the queue unless its deduplication ID was seen recently
+func (q *MemoryQueue) Publish(message OutgoingMessage) error {
+	q.publish(uuid.NewString(), message)
+	return nil
+}
+
+func (q *MemoryQueue) publish(id string, message OutgoingMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if message.DeduplicationID != "" {
+		if seen, ok := q.deduplication[message.DeduplicationID]; ok && now.Sub(seen) < deduplicationWindow {
+			return
+		}
+		q.deduplication[message.DeduplicationID] = now
+	}
+
+	attributes := make(map[string]string, len(message.Attributes))
+	for name, value := range message.Attributes {
+		attributes[name] = value
+	}
+	q.entries = append(q.entries, &memoryEntry{
+		message: Message{ID: id, Body: message.Body, Attributes: attributes},
+	})
+	q.signal()
+}
+
+// SetWaitTime changes how long Receive waits for messages
+func (q *MemoryQueue) SetWaitTime(waitTime time.Duration) {
+	q.waitTime = waitTime
+}
+
+// Receive returns the visible messages, waiting up to the long polling time if there are none
+func (q *MemoryQueue) Receive(ctx context.Context, max int) ([]*Message, error) {
+	timer := time.NewTimer(q.waitTime)
+	defer timer.Stop()
+
+	for {
+		if messages := q.take(max); len(messages) > 0 {
+			return messages, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return q.take(max), nil
+		case <-q.notify:
+		case <-time.After(time.Second):
+			// visibility timeouts expire without a notification
+		}
+	}
+}
+
+func (q *MemoryQueue) take(max int) []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var messages []*Message
+	for _, entry := range q.entries {
+		if len(messages) >= max {
+			break
+		}
+		if entry.invisibleUntil.After(now) {
+			continue
+		}
+		entry.invisibleUntil = now.Add(q.visibilityTimeout)
+		entry.message.ReceiptHandle = uuid.NewString()
+		received := entry.message
+		messages = append(messages, &received)
+	}
+	return messages
+}
+
+// Ack removes the message from the queue
+func (q *MemoryQueue) Ack(ctx context.Context, message *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, entry := range q.entries {
+		if entry.message.ReceiptHandle == message.ReceiptHandle {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("receipt handle %s not found", message.ReceiptHandle)
+}
+
+// Nack makes the message visible again
+func (q *MemoryQueue) Nack(ctx context.Context, message *Message) error {
+	return q.ExtendVisibility(ctx, message, 0)
+}
+
+// ExtendVisibility hides the message for the given duration from now
+func (q *MemoryQueue) ExtendVisibility(ctx context.Context, message *Message, timeout time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, entry := range q.entries {
+		if entry.message.ReceiptHandle == message.ReceiptHandle {
+			entry.invisibleUntil = time.Now().Add(timeout)
+			if timeout == 0 {
+				q.signal()
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("receipt handle %s not found", message.ReceiptHandle)
+}
+
+// Len returns the number of messages in the queue, including in-flight ones
+func (q *MemoryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// signal wakes up a waiting Receive, the caller must hold the lock
+func (q *MemoryQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// ---------------------------------------------------------------- spool directory
+
+const (
+	spoolMessagesFile = "messages.jsonl"
+	spoolAckedFile    = "acked.jsonl"
+)
+
+// spoolRecord is a line of the spool messages file
+type spoolRecord struct {
+	ID              string            `json:"id"`
+	Body            string            `json:"body"`
+	GroupID         string            `json:"group_id,omitempty"`
+	DeduplicationID string            `json:"deduplication_id,omitempty"`
+	Attributes      map[string]string `json:"attributes,omitempty"`
+}
+
+// SpoolQueue is a MessageSource and MessageSink backed by a directory of JSONL files.
+// Published messages are appended to messages.jsonl and acknowledged IDs to acked.jsonl,
+// so messages that were not acknowledged are delivered again after a restart.
+// Events can be enqueued by hand by appending {"id": "...", "body": "..."} lines to messages.jsonl.
+type SpoolQueue struct {
+	*MemoryQueue
+
+	dir    string
+	mu     sync.Mutex
+	offset int64
+	line   int
+	acked  map[string]bool
+}
+
+// NewSpoolQueue returns a queue stored in dir, the directory is created if missing
+func NewSpoolQueue(dir string) (*SpoolQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	q := &SpoolQueue{
+		MemoryQueue: NewMemoryQueue(),
+		dir:         dir,
+		acked:       make(map[string]bool),
+	}
+	// lines appended while waiting are only seen on the next Receive, so keep the wait short
+	q.MemoryQueue.waitTime = time.Second
+	if err := q.loadAcked(); err != nil {
+		return nil, err
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// NewSpoolQueues builds the pipeline queues as subdirectories of dir
+func NewSpoolQueues(dir string) (Queues, error) {
+	source, err := NewSpoolQueue(filepath.Join(dir, "subs"))
+	if err != nil {
+		return Queues{}, err
+	}
+	dlq, err := NewSpoolQueue(filepath.Join(dir, "dlq"))
+	if err != nil {
+		return Queues{}, err
+	}
+	readyImages, err := NewSpoolQueue(filepath.Join(dir, "ready"))
+	if err != nil {
+		return Queues{}, err
+	}
+	return Queues{Source: source, Retry: source, DLQ: dlq, ReadyImages: readyImages}, nil
+}
+
+// Check makes sure the spool directory is still there
+func (q *SpoolQueue) Check(ctx context.Context) error {
+	_, err := os.Stat(q.dir)
+	return err
+}
+
+// loadAcked reads the IDs of the already acknowledged messages
+func (q *SpoolQueue) loadAcked() error {
+	file, err := os.Open(filepath.Join(q.dir, spoolAckedFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open acked spool file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var id string
+		if err := json.Unmarshal(scanner.Bytes(), &id); err == nil {
+			q.acked[id] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// load reads the lines appended to the messages file since the last call
+func (q *SpoolQueue) load() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, err := os.Open(filepath.Join(q.dir, spoolMessagesFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open spool file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(q.offset, 0); err != nil {
+		return fmt.Errorf("failed to seek spool file: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err != nil {
+			// a partial line is read again once it is complete
+			break
+		}
+		q.offset += int64(len(data))
+		q.line++
+
+		var record spoolRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			continue
+		}
+		if record.ID == "" {
+			record.ID = fmt.Sprintf("%s:%d", spoolMessagesFile, q.line)
+		}
+		if q.acked[record.ID] {
+			continue
+		}
+		q.MemoryQueue.publish(record.ID, OutgoingMessage{
+			Body:            record.Body,
+			GroupID:         record.GroupID,
+			DeduplicationID: record.DeduplicationID,
+			Attributes:      record.Attributes,
+		})
+	}
+	return nil
+}
+
+// appendLine appends a JSON encoded value as a line of the given spool file
+func (q *SpoolQueue) appendLine(name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(q.dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Publish appends the message to the spool, it is picked up by the next Receive
+func (q *SpoolQueue) Publish(message OutgoingMessage) error {
+	return q.appendLine(spoolMessagesFile, spoolRecord{
+		ID:              uuid.NewString(),
+		Body:            message.Body,
+		GroupID:         message.GroupID,
+		DeduplicationID: message.DeduplicationID,
+		Attributes:      message.Attributes,
+	})
+}
+
+// Receive picks up new lines of the spool and returns the visible messages
+func (q *SpoolQueue) Receive(ctx context.Context, max int) ([]*Message, error) {
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q.MemoryQueue.Receive(ctx, max)
+}
+
+// Ack removes the message and records it as acknowledged
+func (q *SpoolQueue) Ack(ctx context.Context, message *Message) error {
+	if err := q.MemoryQueue.Ack(ctx, message); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	q.acked[message.ID] = true
+	q.mu.Unlock()
+
+	return q.appendLine(spoolAckedFile, message.ID)
+}
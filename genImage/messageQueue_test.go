@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMemoryQueue(t *testing.T) {
+	tests := []struct {
+		name      string
+		published []OutgoingMessage
+		// handle is called with the messages of the first receive
+		handle func(t *testing.T, q *MemoryQueue, received []*Message)
+		max    int
+		// wantFirst and wantSecond are the bodies returned by the first and the second receive
+		wantFirst  []string
+		wantSecond []string
+		wantLen    int
+	}{
+		{
+			name:       "receive returns the messages in order",
+			published:  []OutgoingMessage{{Body: "a"}, {Body: "b"}},
+			max:        10,
+			wantFirst:  []string{"a", "b"},
+			wantSecond: nil,
+			wantLen:    2,
+		},
+		{
+			name:       "receive is capped to max",
+			published:  []OutgoingMessage{{Body: "a"}, {Body: "b"}, {Body: "c"}},
+			max:        2,
+			wantFirst:  []string{"a", "b"},
+			wantSecond: []string{"c"},
+			wantLen:    3,
+		},
+		{
+			name:       "duplicates are dropped",
+			published:  []OutgoingMessage{{Body: "a", DeduplicationID: "x"}, {Body: "b", DeduplicationID: "x"}, {Body: "c"}},
+			max:        10,
+			wantFirst:  []string{"a", "c"},
+			wantSecond: nil,
+			wantLen:    2,
+		},
+		{
+			name:      "ack removes the message",
+			published: []OutgoingMessage{{Body: "a"}, {Body: "b"}},
+			handle: func(t *testing.T, q *MemoryQueue, received []*Message) {
+				if err := q.Ack(context.Background(), received[0]); err != nil {
+					t.Fatalf("Ack() error = %v", err)
+				}
+			},
+			max:        10,
+			wantFirst:  []string{"a", "b"},
+			wantSecond: nil,
+			wantLen:    1,
+		},
+		{
+			name:      "nack makes the message visible again",
+			published: []OutgoingMessage{{Body: "a"}, {Body: "b"}},
+			handle: func(t *testing.T, q *MemoryQueue, received []*Message) {
+				if err := q.Nack(context.Background(), received[1]); err != nil {
+					t.Fatalf("Nack() error = %v", err)
+				}
+			},
+			max:        10,
+			wantFirst:  []string{"a", "b"},
+			wantSecond: []string{"b"},
+			wantLen:    2,
+		},
+		{
+			name:      "expired visibility makes the message visible again",
+			published: []OutgoingMessage{{Body: "a"}},
+			handle: func(t *testing.T, q *MemoryQueue, received []*Message) {
+				if err := q.ExtendVisibility(context.Background(), received[0], time.Millisecond); err != nil {
+					t.Fatalf("ExtendVisibility() error = %v", err)
+				}
+				time.Sleep(5 * time.Millisecond)
+			},
+			max:        10,
+			wantFirst:  []string{"a"},
+			wantSecond: []string{"a"},
+			wantLen:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewMemoryQueue()
+			q.SetWaitTime(0)
+			for _, message := range tt.published {
+				if err := q.Publish(message); err != nil {
+					t.Fatalf("Publish() error = %v", err)
+				}
+			}
+
+			first := receive(t, q, tt.max)
+			if !slices.Equal(bodies(first), tt.wantFirst) {
+				t.Errorf("first Receive() = %v, want %v", bodies(first), tt.wantFirst)
+			}
+			if tt.handle != nil {
+				tt.handle(t, q, first)
+			}
+			second := receive(t, q, tt.max)
+			if !slices.Equal(bodies(second), tt.wantSecond) {
+				t.Errorf("second Receive() = %v, want %v", bodies(second), tt.wantSecond)
+			}
+			if got := q.Len(); got != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", got, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestMemoryQueueAckUnknownReceipt(t *testing.T) {
+	q := NewMemoryQueue()
+	if err := q.Ack(context.Background(), &Message{ReceiptHandle: "unknown"}); err == nil {
+		t.Error("Ack() of an unknown receipt handle returned no error")
+	}
+}
+
+func TestMemoryQueueReceiveWaitsForPublish(t *testing.T) {
+	q := NewMemoryQueue()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Publish(OutgoingMessage{Body: "late"})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	messages, err := q.Receive(ctx, 1)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if got := bodies(messages); !slices.Equal(got, []string{"late"}) {
+		t.Errorf("Receive() = %v, want [late]", got)
+	}
+}
+
+func receive(t *testing.T, q *MemoryQueue, max int) []*Message {
+	t.Helper()
+	messages, err := q.Receive(context.Background(), max)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	return messages
+}
+
+func bodies(messages []*Message) []string {
+	var bodies []string
+	for _, message := range messages {
+		bodies = append(bodies, message.Body)
+	}
+	return bodies
+}
@@ -0,0 +1,60 @@
+// this module defines the Prometheus metrics of the service, they are served on /metrics by the health server
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// pipeline stages whose latency is measured, besides the retried ones
+const (
+	stageDownload = "download"
+	stagePublish  = "publish"
+)
+
+var (
+	messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "genimage_messages_received_total",
+		Help: "Messages received from the source queue.",
+	})
+
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "genimage_stage_duration_seconds",
+		Help: "Duration of the pipeline stages: description, generation, download and publish.",
+		// the generation takes tens of seconds, the lookups a few milliseconds
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+	}, []string{"stage"})
+
+	messageFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "genimage_failures_total",
+		Help: "Messages moved to the DLQ, by FailureReason.",
+	}, []string{"reason"})
+
+	modelGenerations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "genimage_model_generations_total",
+		Help: "Generations attempted with every model, by outcome (success or failure).",
+	}, []string{"provider", "model", "outcome"})
+
+	sinkPublications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "genimage_sink_publications_total",
+		Help: "Images published to every sink, by outcome (success, failure or filtered out).",
+	}, []string{"sink", "outcome"})
+
+	discordRateLimits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "genimage_discord_rate_limits_total",
+		Help: "Discord posts rejected with a 429, they are retried after the Retry-After delay.",
+	})
+
+	rarityRolls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "genimage_rarity_rolls_total",
+		Help: "Rarity tiers rolled for the prompts.",
+	}, []string{"rarity"})
+)
+
+// observeStage records the duration of a stage started at start
+func observeStage(stage string, start time.Time) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,265 @@
+// this module loads the models of models.json with their generation parameters
+// and picks the model to use by weight, together with the fallbacks to try if it fails
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// featureTextRendering is the feature of the models that can write legible text, like the sign texts
+	featureTextRendering = "text_rendering"
+
+	// aspectRatioArea is the number of pixels of an image sized by aspect ratio, the same as 1024x1024
+	aspectRatioArea = 1024 * 1024
+	// dimensionStep is the multiple the Runware API requires for width and height
+	dimensionStep = 64
+)
+
+// ModelsConfig represents the structure of the models JSON file
+type ModelsConfig struct {
+	Models []ModelConfig `json:"models"`
+}
+
+// ModelConfig is a model that can be used for the generation, with the parameters sent with it.
+// Zero values are not sent, so the model defaults apply.
+type ModelConfig struct {
+	ID     string `json:"id"`
+	Weight int    `json:"weight"`
+	// Provider is the image provider generating with the model, runware or gemini, runware if empty
+	Provider string `json:"provider"`
+	// Width and Height are the size of the image, AspectRatio (like "16:9") can be used instead.
+	// Some models only generate their own size, for them none of the three must be set.
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	AspectRatio string  `json:"aspect_ratio"`
+	Steps       int     `json:"steps"`
+	CFGScale    float64 `json:"cfg_scale"`
+	Scheduler   string  `json:"scheduler"`
+	// Features are the capabilities of the model, like text_rendering
+	Features []string `json:"features"`
+	// Fallbacks are the IDs of the models to try, in order, when this model fails
+	Fallbacks []string `json:"fallbacks"`
+}
+
+// loadModelsConfig reads and validates models.json, it is read for every generation so it can be changed while running
+func loadModelsConfig(path string) (*ModelsConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var config ModelsConfig
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// validate checks that the models are usable and that the fallbacks exist
+func (c *ModelsConfig) validate() error {
+	if len(c.Models) == 0 {
+		return fmt.Errorf("no models found")
+	}
+
+	ids := make(map[string]bool)
+	totalWeight := 0
+	for _, model := range c.Models {
+		if model.ID == "" {
+			return fmt.Errorf("every model needs an id")
+		}
+		if ids[model.ID] {
+			return fmt.Errorf("model %s is listed twice", model.ID)
+		}
+		ids[model.ID] = true
+
+		switch model.providerName() {
+		case runwareProviderName:
+		case geminiProviderName:
+			// Imagen only takes an aspect ratio
+			if model.Width != 0 || model.Steps != 0 || model.Scheduler != "" {
+				return fmt.Errorf("model %s: gemini models only support aspect_ratio and cfg_scale", model.ID)
+			}
+		default:
+			return fmt.Errorf("model %s: unknown provider %s", model.ID, model.Provider)
+		}
+
+		if model.Weight < 0 {
+			return fmt.Errorf("model %s: weight must not be negative", model.ID)
+		}
+		totalWeight += model.Weight
+
+		if (model.Width == 0) != (model.Height == 0) {
+			return fmt.Errorf("model %s: width and height must be set together", model.ID)
+		}
+		if model.AspectRatio != "" {
+			if model.Width != 0 {
+				return fmt.Errorf("model %s: set either width and height or aspect_ratio", model.ID)
+			}
+			if _, _, err := parseAspectRatio(model.AspectRatio); err != nil {
+				return fmt.Errorf("model %s: %w", model.ID, err)
+			}
+		}
+	}
+	if totalWeight == 0 {
+		return fmt.Errorf("at least one model weight must be positive")
+	}
+
+	for _, model := range c.Models {
+		for _, fallback := range model.Fallbacks {
+			if !ids[fallback] {
+				return fmt.Errorf("model %s: unknown fallback %s", model.ID, fallback)
+			}
+		}
+	}
+	return nil
+}
+
+// model returns the model with the given ID, or nil if it is not configured
+func (c *ModelsConfig) model(id string) *ModelConfig {
+	for i := range c.Models {
+		if c.Models[i].ID == id {
+			return &c.Models[i]
+		}
+	}
+	return nil
+}
+
+// providerName returns the name of the image provider generating with the model
+func (m *ModelConfig) providerName() string {
+	if m.Provider == "" {
+		return runwareProviderName
+	}
+	return m.Provider
+}
+
+// hasFeatures reports whether the model supports all the features
+func (m *ModelConfig) hasFeatures(features []string) bool {
+	for _, feature := range features {
+		supported := false
+		for _, modelFeature := range m.Features {
+			if modelFeature == feature {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates picks a model by weight among the ones supporting the required features,
+// and returns it followed by its fallbacks. If no model supports the features, any model is picked.
+func (c *ModelsConfig) candidates(ctx context.Context, requiredFeatures []string) []*ModelConfig {
+	weights := make([]int, len(c.Models))
+	for i := range c.Models {
+		if c.Models[i].hasFeatures(requiredFeatures) {
+			weights[i] = c.Models[i].Weight
+		}
+	}
+
+	picked := weightedIndex(weights)
+	if picked < 0 {
+		if len(requiredFeatures) > 0 {
+			slog.WarnContext(ctx, "No model supports the required features, picking any model", "features", strings.Join(requiredFeatures, ", "))
+		}
+		for i := range c.Models {
+			weights[i] = c.Models[i].Weight
+		}
+		// validate makes sure at least one weight is positive
+		picked = weightedIndex(weights)
+	}
+
+	candidates := []*ModelConfig{&c.Models[picked]}
+	tried := map[string]bool{c.Models[picked].ID: true}
+	for _, id := range c.Models[picked].Fallbacks {
+		if tried[id] {
+			continue
+		}
+		tried[id] = true
+		candidates = append(candidates, c.model(id))
+	}
+	return candidates
+}
+
+// dimensions returns the width and height to request, zero if the model decides them
+func (m *ModelConfig) dimensions() (int, int) {
+	if m.AspectRatio == "" {
+		return m.Width, m.Height
+	}
+
+	// validate already checked the aspect ratio
+	ratioWidth, ratioHeight, _ := parseAspectRatio(m.AspectRatio)
+	height := math.Sqrt(aspectRatioArea * ratioHeight / ratioWidth)
+	width := height * ratioWidth / ratioHeight
+	return roundToStep(width), roundToStep(height)
+}
+
+// parseAspectRatio parses an aspect ratio like "16:9"
+func parseAspectRatio(aspectRatio string) (float64, float64, error) {
+	parts := strings.Split(aspectRatio, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, expected width:height", aspectRatio)
+	}
+
+	width, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, expected width:height", aspectRatio)
+	}
+	height, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, expected width:height", aspectRatio)
+	}
+	return width, height, nil
+}
+
+// roundToStep rounds a dimension to the nearest multiple of dimensionStep
+func roundToStep(dimension float64) int {
+	steps := int(math.Round(dimension / dimensionStep))
+	if steps < 1 {
+		steps = 1
+	}
+	return steps * dimensionStep
+}
+
+// runwarePayload builds the imageInference task for the model
+func (m *ModelConfig) runwarePayload(taskUUID string, prompt string) map[string]interface{} {
+	task := map[string]interface{}{
+		"taskType":       "imageInference",
+		"taskUUID":       taskUUID,
+		"positivePrompt": prompt,
+		"model":          m.ID,
+		"numberResults":  1,
+	}
+
+	if width, height := m.dimensions(); width > 0 {
+		task["width"] = width
+		task["height"] = height
+	}
+	if m.Steps > 0 {
+		task["steps"] = m.Steps
+	}
+	if m.CFGScale > 0 {
+		task["CFGScale"] = m.CFGScale
+	}
+	if m.Scheduler != "" {
+		task["scheduler"] = m.Scheduler
+	}
+	return task
+}
@@ -1,3 +1,263 @@
 // this module will send a notification to a telegram bot when an error occurs
+// alerts with the same key are collapsed: the first one is sent right away, the repetitions
+// within the repeat window are counted and sent later as a single summary
 
-package main;
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier sends alerts about failures to the maintainers
+type Notifier interface {
+	// Notify sends an alert, alerts with the same key are deduplicated
+	Notify(key string, text string)
+	// Close sends the pending summaries and stops the notifier
+	Close()
+}
+
+// noopNotifier discards the alerts, it is used when telegram is not configured
+type noopNotifier struct{}
+
+func (noopNotifier) Notify(key string, text string) {}
+func (noopNotifier) Close()                         {}
+
+// TelegramSettings configures the telegram notifier
+type TelegramSettings struct {
+	// BaseURL is the Bot API URL, it can point to a local server in tests
+	BaseURL string `json:"base_url"`
+	// RepeatWindowSeconds is the minimum time between two alerts with the same key
+	RepeatWindowSeconds int `json:"repeat_window_seconds"`
+	// MaxMessagesPerMinute caps the messages sent to the chat
+	MaxMessagesPerMinute int `json:"max_messages_per_minute"`
+}
+
+// DefaultTelegramSettings returns the settings used when settings.json doesn't define them
+func DefaultTelegramSettings() TelegramSettings {
+	return TelegramSettings{
+		BaseURL:              "https://api.telegram.org",
+		RepeatWindowSeconds:  300,
+		MaxMessagesPerMinute: 20,
+	}
+}
+
+// alertState tracks the alerts sent for a key
+type alertState struct {
+	lastSent   time.Time
+	lastText   string
+	suppressed int
+}
+
+// TelegramNotifier sends alerts to a telegram chat through the Bot API
+type TelegramNotifier struct {
+	baseURL       string
+	botToken      string
+	chatID        string
+	repeatWindow  time.Duration
+	maxPerMinute  int
+	client        *http.Client
+	mu            sync.Mutex
+	alerts        map[string]*alertState
+	recentlySent  []time.Time
+	outgoing      chan string
+	done          chan struct{}
+	senderStopped chan struct{}
+	closed        bool
+	closeOnce     sync.Once
+}
+
+// NewTelegramNotifier returns a notifier posting to the given chat, call Close to flush it
+func NewTelegramNotifier(settings TelegramSettings, botToken string, chatID string) *TelegramNotifier {
+	defaults := DefaultTelegramSettings()
+	if settings.BaseURL == "" {
+		settings.BaseURL = defaults.BaseURL
+	}
+	if settings.RepeatWindowSeconds <= 0 {
+		settings.RepeatWindowSeconds = defaults.RepeatWindowSeconds
+	}
+	if settings.MaxMessagesPerMinute <= 0 {
+		settings.MaxMessagesPerMinute = defaults.MaxMessagesPerMinute
+	}
+
+	n := &TelegramNotifier{
+		baseURL:       strings.TrimRight(settings.BaseURL, "/"),
+		botToken:      botToken,
+		chatID:        chatID,
+		repeatWindow:  time.Duration(settings.RepeatWindowSeconds) * time.Second,
+		maxPerMinute:  settings.MaxMessagesPerMinute,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		alerts:        make(map[string]*alertState),
+		outgoing:      make(chan string, 100),
+		done:          make(chan struct{}),
+		senderStopped: make(chan struct{}),
+	}
+
+	go n.sendLoop()
+	go n.summaryLoop()
+
+	return n
+}
+
+// Notify sends the alert unless an alert with the same key was sent within the repeat window,
+// in that case it is counted and reported in the next summary
+func (n *TelegramNotifier) Notify(key string, text string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	state, ok := n.alerts[key]
+	if !ok {
+		state = &alertState{}
+		n.alerts[key] = state
+	}
+	state.lastText = text
+
+	if now.Sub(state.lastSent) < n.repeatWindow || !n.allowLocked(now) {
+		state.suppressed++
+		return
+	}
+
+	state.lastSent = now
+	n.enqueueLocked(text)
+}
+
+// allowLocked applies the global rate limit, the caller must hold the lock
+func (n *TelegramNotifier) allowLocked(now time.Time) bool {
+	recent := n.recentlySent[:0]
+	for _, sent := range n.recentlySent {
+		if now.Sub(sent) < time.Minute {
+			recent = append(recent, sent)
+		}
+	}
+	n.recentlySent = recent
+
+	return len(n.recentlySent) < n.maxPerMinute
+}
+
+// enqueueLocked queues a message for the sender, the caller must hold the lock
+func (n *TelegramNotifier) enqueueLocked(text string) {
+	if n.closed {
+		slog.Warn("Telegram notifier closed, dropping alert", "alert", text)
+		return
+	}
+	n.recentlySent = append(n.recentlySent, time.Now())
+
+	select {
+	case n.outgoing <- text:
+	default:
+		slog.Warn("Telegram notification queue full, dropping alert", "alert", text)
+	}
+}
+
+// summaryLoop periodically sends a summary for the keys with suppressed alerts
+func (n *TelegramNotifier) summaryLoop() {
+	ticker := time.NewTicker(n.repeatWindow / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.sendSummaries(false)
+		}
+	}
+}
+
+// sendSummaries sends a summary for every key with suppressed alerts whose repeat window expired,
+// or for every key with suppressed alerts if force is set
+func (n *TelegramNotifier) sendSummaries(force bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(n.alerts))
+	for key := range n.alerts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		state := n.alerts[key]
+		if state.suppressed == 0 {
+			continue
+		}
+		if !force && (now.Sub(state.lastSent) < n.repeatWindow || !n.allowLocked(now)) {
+			continue
+		}
+
+		n.enqueueLocked(fmt.Sprintf("%d more alerts of type %q since %s, last one:\n%s",
+			state.suppressed, key, state.lastSent.Format("15:04:05"), state.lastText))
+		state.lastSent = now
+		state.suppressed = 0
+	}
+}
+
+// sendLoop posts the queued messages one at a time, so they arrive in order
+func (n *TelegramNotifier) sendLoop() {
+	defer close(n.senderStopped)
+
+	for text := range n.outgoing {
+		if err := n.send(text); err != nil {
+			slog.Error("Failed to send telegram notification", "error", err)
+		}
+	}
+}
+
+// send posts a message to the chat
+func (n *TelegramNotifier) send(text string) error {
+	payload, err := json.Marshal(map[string]string{
+		"chat_id": n.chatID,
+		"text":    "SubVision genImage\n" + text,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal telegram message: %w", err)
+	}
+
+	apiURL := fmt.Sprintf("%s/bot%s/sendMessage", n.baseURL, n.botToken)
+	resp, err := n.client.Post(apiURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		// The URL of the error holds the bot token
+		return fmt.Errorf("failed to call telegram API: %w", redactToken(err, n.botToken))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("telegram API returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// Close sends the pending summaries and waits for the queued messages to be sent
+func (n *TelegramNotifier) Close() {
+	n.closeOnce.Do(func() {
+		close(n.done)
+		n.sendSummaries(true)
+
+		n.mu.Lock()
+		n.closed = true
+		close(n.outgoing)
+		n.mu.Unlock()
+
+		<-n.senderStopped
+	})
+}
+
+// newNotifier returns the telegram notifier, or a notifier that does nothing if telegram is not configured
+func newNotifier(settings TelegramSettings, botToken string, chatID string) Notifier {
+	if botToken == "" || chatID == "" {
+		slog.Warn("Telegram configuration is missing: bot token or chat ID not set, alerts are disabled")
+		return noopNotifier{}
+	}
+	return NewTelegramNotifier(settings, botToken, chatID)
+}
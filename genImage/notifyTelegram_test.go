@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// telegramStub is a Bot API recording the texts of the messages sent to it
+type telegramStub struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+func newTelegramStub(t *testing.T) (*httptest.Server, *telegramStub) {
+	t.Helper()
+	stub := &telegramStub{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottoken/sendMessage" {
+			t.Errorf("request path = %s, want /bottoken/sendMessage", r.URL.Path)
+		}
+		var message struct {
+			ChatID string `json:"chat_id"`
+			Text   string `json:"text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Errorf("invalid message: %v", err)
+		}
+		stub.mu.Lock()
+		stub.texts = append(stub.texts, strings.TrimPrefix(message.Text, "SubVision genImage\n"))
+		stub.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return server, stub
+}
+
+func (s *telegramStub) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.texts...)
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	type alert struct{ key, text string }
+
+	tests := []struct {
+		name         string
+		maxPerMinute int
+		alerts       []alert
+		// wantBeforeClose are the texts sent right away, wantAfterClose the ones sent by Close
+		wantBeforeClose []string
+		wantAfterClose  []string
+	}{
+		{
+			name:            "different keys are all sent",
+			alerts:          []alert{{"receive", "a"}, {"dlq", "b"}},
+			wantBeforeClose: []string{"a", "b"},
+		},
+		{
+			name:            "repetitions are collapsed into a summary",
+			alerts:          []alert{{"receive", "a"}, {"receive", "b"}, {"receive", "c"}},
+			wantBeforeClose: []string{"a"},
+			wantAfterClose:  []string{`2 more alerts of type "receive"`},
+		},
+		{
+			name:            "alerts over the rate limit are summarized",
+			maxPerMinute:    2,
+			alerts:          []alert{{"a", "a"}, {"b", "b"}, {"c", "c"}},
+			wantBeforeClose: []string{"a", "b"},
+			wantAfterClose:  []string{`1 more alerts of type "c"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, stub := newTelegramStub(t)
+			n := NewTelegramNotifier(TelegramSettings{BaseURL: server.URL, MaxMessagesPerMinute: tt.maxPerMinute}, "token", "chat")
+
+			for _, alert := range tt.alerts {
+				n.Notify(alert.key, alert.text)
+			}
+			waitForTexts(t, stub, len(tt.wantBeforeClose))
+			n.Close()
+
+			sent := stub.sent()
+			if len(sent) != len(tt.wantBeforeClose)+len(tt.wantAfterClose) {
+				t.Fatalf("sent %q, want %q then %q", sent, tt.wantBeforeClose, tt.wantAfterClose)
+			}
+			for i, want := range tt.wantBeforeClose {
+				if sent[i] != want {
+					t.Errorf("message %d = %q, want %q", i, sent[i], want)
+				}
+			}
+			for i, want := range tt.wantAfterClose {
+				if got := sent[len(tt.wantBeforeClose)+i]; !strings.HasPrefix(got, want) {
+					t.Errorf("summary %d = %q, want prefix %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTelegramNotifierSendsSummaryAfterRepeatWindow(t *testing.T) {
+	server, stub := newTelegramStub(t)
+	n := NewTelegramNotifier(TelegramSettings{BaseURL: server.URL, RepeatWindowSeconds: 1}, "token", "chat")
+	defer n.Close()
+
+	n.Notify("receive", "first")
+	n.Notify("receive", "second")
+
+	waitForTexts(t, stub, 2)
+	sent := stub.sent()
+	if !strings.HasPrefix(sent[1], `1 more alerts of type "receive"`) || !strings.HasSuffix(sent[1], "second") {
+		t.Errorf("summary = %q, want the count and the last alert", sent[1])
+	}
+}
+
+func TestTelegramNotifierClose(t *testing.T) {
+	server, stub := newTelegramStub(t)
+	n := NewTelegramNotifier(TelegramSettings{BaseURL: server.URL}, "token", "chat")
+
+	n.Notify("receive", "before")
+	n.Close()
+	// Closing twice and notifying once closed must neither panic nor send
+	n.Close()
+	n.Notify("other", "after")
+
+	if sent := stub.sent(); len(sent) != 1 || sent[0] != "before" {
+		t.Errorf("sent %q, want [before]", sent)
+	}
+}
+
+func TestTelegramNotifierRedactsToken(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	n := NewTelegramNotifier(TelegramSettings{BaseURL: server.URL}, "secret-token", "chat")
+	defer n.Close()
+
+	err := n.send("alert")
+	if err == nil {
+		t.Fatal("send() to a closed server returned no error")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("send() error = %q, it contains the bot token", err)
+	}
+}
+
+// waitForTexts waits until the stub received count messages
+func waitForTexts(t *testing.T, stub *telegramStub, count int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(stub.sent()) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d messages, want %d", len(stub.sent()), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
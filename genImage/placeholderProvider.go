@@ -0,0 +1,156 @@
+// this module renders a placeholder PNG listing the prompt attributes instead of generating an image,
+// so dev and CI runs go through the whole pipeline without spending credits or needing network
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	placeholderProviderName = "placeholder"
+
+	// placeholderScale is how much the text, drawn with a small bitmap font, is enlarged
+	placeholderScale = 3
+	// placeholderSize is used when the model doesn't set the dimensions
+	placeholderSize   = 1024
+	placeholderMargin = 8
+)
+
+// PlaceholderProvider is an ImageProvider drawing the prompt attributes on a plain background.
+// The same request always gives the same image.
+type PlaceholderProvider struct{}
+
+// NewPlaceholderProvider returns the placeholder provider
+func NewPlaceholderProvider() *PlaceholderProvider {
+	return &PlaceholderProvider{}
+}
+
+// Name returns the name of the provider
+func (p *PlaceholderProvider) Name() string {
+	return placeholderProviderName
+}
+
+// Generate renders the placeholder image
+func (p *PlaceholderProvider) Generate(ctx context.Context, request ImageRequest) (*GeneratedImage, error) {
+	width, height := placeholderSize, placeholderSize
+	if w, h := request.Model.dimensions(); w > 0 {
+		width, height = w, h
+	}
+
+	// The text is drawn on a small image which is then enlarged, so it is readable on the overlay
+	small := image.NewRGBA(image.Rect(0, 0, width/placeholderScale, height/placeholderScale))
+	background, foreground := placeholderColors(request)
+	draw.Draw(small, small.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	drawer := &font.Drawer{
+		Dst:  small,
+		Src:  image.NewUniform(foreground),
+		Face: basicfont.Face7x13,
+	}
+	lineHeight := basicfont.Face7x13.Metrics().Height.Ceil()
+	maxChars := (small.Bounds().Dx() - 2*placeholderMargin) / basicfont.Face7x13.Advance
+
+	y := placeholderMargin + lineHeight
+	for _, line := range placeholderLines(request) {
+		for _, wrapped := range wrapText(line, maxChars) {
+			if y > small.Bounds().Dy()-placeholderMargin {
+				break
+			}
+			drawer.Dot = fixed.P(placeholderMargin, y)
+			drawer.DrawString(wrapped)
+			y += lineHeight
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.NearestNeighbor.Scale(img, img.Bounds(), small, small.Bounds(), draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, permanentError(fmt.Errorf("failed to encode placeholder image: %w", err))
+	}
+
+	return &GeneratedImage{
+		Data:     buf.Bytes(),
+		Format:   "png",
+		Provider: placeholderProviderName,
+		Model:    request.Model.ID,
+	}, nil
+}
+
+// placeholderLines returns the text of the placeholder image
+func placeholderLines(request ImageRequest) []string {
+	prompt := request.Prompt
+	lines := []string{
+		"PLACEHOLDER",
+		"",
+		"User: " + request.Username,
+		"Model: " + request.Model.ID,
+		"Base prompt: " + prompt.BasePrompt,
+		"Rarity: " + prompt.Rarity,
+		"Background: " + prompt.Background,
+		"Emotion: " + prompt.Emotion,
+		"Subject is " + prompt.ActionOrSign,
+	}
+	for _, modifier := range prompt.EventModifiers {
+		lines = append(lines, "- "+modifier)
+	}
+	return lines
+}
+
+// placeholderColors derives the colors from the request, so different requests are told apart at a glance
+func placeholderColors(request ImageRequest) (color.RGBA, color.RGBA) {
+	hash := fnv.New32a()
+	hash.Write([]byte(request.Username))
+	hash.Write([]byte(request.Prompt.Text))
+	sum := hash.Sum32()
+
+	// a dark background keeps the white text readable
+	background := color.RGBA{R: uint8(sum>>16) / 3, G: uint8(sum>>8) / 3, B: uint8(sum) / 3, A: 255}
+	return background, color.RGBA{R: 255, G: 255, B: 255, A: 255}
+}
+
+// wrapText splits the text in lines of at most maxChars characters, breaking at spaces when possible
+func wrapText(text string, maxChars int) []string {
+	if maxChars <= 0 || len(text) <= maxChars {
+		return []string{text}
+	}
+
+	var lines []string
+	var line strings.Builder
+	for _, word := range strings.Fields(text) {
+		for len(word) > maxChars {
+			if line.Len() > 0 {
+				lines = append(lines, line.String())
+				line.Reset()
+			}
+			lines = append(lines, word[:maxChars])
+			word = word[maxChars:]
+		}
+		if line.Len() > 0 && line.Len()+1+len(word) > maxChars {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(word)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
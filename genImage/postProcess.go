@@ -0,0 +1,301 @@
+// this module post-processes the generated images before they are stored: it decodes whatever format
+// the provider returned, resizes and re-encodes the image, adds the optional watermark and nameplate
+// and produces the thumbnail
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	// the providers can return WebP images, the pure Go decoder works in every build
+	_ "golang.org/x/image/webp"
+)
+
+// PostProcessSettings configures the post-processing of the images
+type PostProcessSettings struct {
+	// Enabled false stores the images as returned by the provider
+	Enabled bool `json:"enabled"`
+	// Format is the format the images are re-encoded to: jpeg, webp or png
+	Format string `json:"format"`
+	// Quality is the JPEG or WebP quality, from 1 to 100
+	Quality int `json:"quality"`
+	// MaxSize is the maximum width and height of the image, larger images are scaled down
+	MaxSize int `json:"max_size"`
+	// ThumbnailSize is the maximum width and height of the thumbnail, 0 disables the thumbnail
+	ThumbnailSize    int `json:"thumbnail_size"`
+	ThumbnailQuality int `json:"thumbnail_quality"`
+
+	Watermark WatermarkSettings `json:"watermark"`
+	Nameplate NameplateSettings `json:"nameplate"`
+}
+
+// WatermarkSettings configures the channel watermark in the bottom right corner
+type WatermarkSettings struct {
+	Enabled bool `json:"enabled"`
+	// Image is the path of a PNG used as watermark, Text is drawn instead if it is empty
+	Image string `json:"image"`
+	Text  string `json:"text"`
+	// Opacity is from 0 (invisible) to 1
+	Opacity float64 `json:"opacity"`
+}
+
+// NameplateSettings configures the bar with the username at the bottom of the image
+type NameplateSettings struct {
+	Enabled bool `json:"enabled"`
+}
+
+// DefaultPostProcessSettings returns the post-processing used when settings.json doesn't configure it
+func DefaultPostProcessSettings() PostProcessSettings {
+	return PostProcessSettings{
+		Enabled:          true,
+		Format:           "jpeg",
+		Quality:          90,
+		MaxSize:          1024,
+		ThumbnailSize:    256,
+		ThumbnailQuality: 80,
+		Watermark: WatermarkSettings{
+			Opacity: 0.6,
+		},
+	}
+}
+
+// Asset is an encoded image ready to be stored
+type Asset struct {
+	Data   []byte
+	Format string
+	Width  int
+	Height int
+}
+
+// ProcessedImage is the image to store and its thumbnail, which is nil when thumbnails are disabled
+type ProcessedImage struct {
+	Image     Asset
+	Thumbnail *Asset
+}
+
+// PostProcessor applies the post-processing settings, the watermark and the font are loaded once
+type PostProcessor struct {
+	settings  PostProcessSettings
+	watermark image.Image
+	font      *opentype.Font
+}
+
+// NewPostProcessor validates the settings and loads what the post-processing needs
+func NewPostProcessor(settings PostProcessSettings) (*PostProcessor, error) {
+	processor := &PostProcessor{settings: settings}
+	if !settings.Enabled {
+		return processor, nil
+	}
+
+	switch settings.Format {
+	case "jpeg", "webp", "png":
+	default:
+		return nil, fmt.Errorf("unsupported post-processing format %q, expected jpeg, webp or png", settings.Format)
+	}
+	if settings.Format == "webp" && !webpEncodingAvailable {
+		return nil, fmt.Errorf("post-processing format webp needs a build with cgo, use jpeg or png")
+	}
+	if settings.Quality < 1 || settings.Quality > 100 || (settings.ThumbnailSize > 0 && (settings.ThumbnailQuality < 1 || settings.ThumbnailQuality > 100)) {
+		return nil, fmt.Errorf("post-processing quality must be from 1 to 100")
+	}
+
+	if settings.Watermark.Enabled && settings.Watermark.Image != "" {
+		file, err := os.Open(settings.Watermark.Image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open watermark: %w", err)
+		}
+		defer file.Close()
+
+		processor.watermark, err = png.Decode(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode watermark %s: %w", settings.Watermark.Image, err)
+		}
+	}
+
+	if settings.Nameplate.Enabled || (settings.Watermark.Enabled && settings.Watermark.Image == "") {
+		var err error
+		processor.font, err = opentype.Parse(gobold.TTF)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse font: %w", err)
+		}
+	}
+
+	return processor, nil
+}
+
+// Process decodes the generated image and produces the assets to store
+func (p *PostProcessor) Process(ctx context.Context, generated *GeneratedImage, username string) (*ProcessedImage, error) {
+	if !p.settings.Enabled {
+		config, _, err := image.DecodeConfig(bytes.NewReader(generated.Data))
+		if err != nil {
+			return nil, permanentError(fmt.Errorf("failed to decode %s image: %w", generated.Format, err))
+		}
+		return &ProcessedImage{Image: Asset{Data: generated.Data, Format: generated.Format, Width: config.Width, Height: config.Height}}, nil
+	}
+
+	// The format is detected from the data, providers don't always return what they are asked for
+	decoded, format, err := image.Decode(bytes.NewReader(generated.Data))
+	if err != nil {
+		return nil, permanentError(fmt.Errorf("failed to decode image: %w", err))
+	}
+	if format != generated.Format {
+		slog.WarnContext(ctx, "Provider returned another format than detected", "provider", generated.Provider, "format", format, "expected_format", generated.Format)
+	}
+
+	img := resizeToFit(decoded, p.settings.MaxSize)
+
+	if p.settings.Nameplate.Enabled {
+		p.drawNameplate(ctx, img, username)
+	}
+	if p.settings.Watermark.Enabled {
+		p.drawWatermark(ctx, img)
+	}
+
+	full, err := encodeAsset(img, p.settings.Format, p.settings.Quality)
+	if err != nil {
+		return nil, err
+	}
+	processed := &ProcessedImage{Image: full}
+
+	if p.settings.ThumbnailSize > 0 {
+		thumbnail, err := encodeAsset(resizeToFit(img, p.settings.ThumbnailSize), p.settings.Format, p.settings.ThumbnailQuality)
+		if err != nil {
+			return nil, err
+		}
+		processed.Thumbnail = &thumbnail
+	}
+
+	return processed, nil
+}
+
+// resizeToFit returns a copy of the image scaled down to fit in maxSize x maxSize, 0 keeps the size
+func resizeToFit(img image.Image, maxSize int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if maxSize > 0 && (width > maxSize || height > maxSize) {
+		if width >= height {
+			height = height * maxSize / width
+			width = maxSize
+		} else {
+			width = width * maxSize / height
+			height = maxSize
+		}
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+	return resized
+}
+
+// encodeAsset encodes the image in the format
+func encodeAsset(img image.Image, format string, quality int) (Asset, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "webp":
+		var data []byte
+		data, err = encodeWebP(img, quality)
+		buf.Write(data)
+	}
+	if err != nil {
+		return Asset{}, permanentError(fmt.Errorf("failed to encode %s image: %w", format, err))
+	}
+
+	bounds := img.Bounds()
+	return Asset{Data: buf.Bytes(), Format: format, Width: bounds.Dx(), Height: bounds.Dy()}, nil
+}
+
+// drawNameplate draws the username on a translucent bar at the bottom of the image
+func (p *PostProcessor) drawNameplate(ctx context.Context, img *image.RGBA, username string) {
+	bounds := img.Bounds()
+	barHeight := bounds.Dy() / 12
+	bar := image.Rect(bounds.Min.X, bounds.Max.Y-barHeight, bounds.Max.X, bounds.Max.Y)
+	draw.Draw(img, bar, image.NewUniform(color.RGBA{A: 160}), image.Point{}, draw.Over)
+
+	face, err := opentype.NewFace(p.font, &opentype.FaceOptions{Size: float64(barHeight) * 0.55, DPI: 72})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to create nameplate font", "error", err)
+		return
+	}
+	defer face.Close()
+
+	drawer := &font.Drawer{Dst: img, Src: image.White, Face: face}
+	textWidth := drawer.MeasureString(username).Ceil()
+	metrics := face.Metrics()
+	// the text is centered in the bar
+	x := bar.Min.X + (bar.Dx()-textWidth)/2
+	y := bar.Min.Y + (barHeight+metrics.Ascent.Ceil()-metrics.Descent.Ceil())/2
+	drawer.Dot = fixed.P(x, y)
+	drawer.DrawString(username)
+}
+
+// drawWatermark draws the watermark image, or text, in the bottom right corner
+func (p *PostProcessor) drawWatermark(ctx context.Context, img *image.RGBA) {
+	bounds := img.Bounds()
+	margin := bounds.Dx() / 40
+	// the watermark stays above the nameplate
+	bottom := bounds.Max.Y - margin
+	if p.settings.Nameplate.Enabled {
+		bottom -= bounds.Dy() / 12
+	}
+	opacity := image.NewUniform(color.Alpha{A: uint8(255 * clamp(p.settings.Watermark.Opacity, 0, 1))})
+
+	if p.watermark != nil {
+		// the watermark takes a sixth of the image width
+		width := bounds.Dx() / 6
+		height := p.watermark.Bounds().Dy() * width / p.watermark.Bounds().Dx()
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), p.watermark, p.watermark.Bounds(), draw.Src, nil)
+
+		target := image.Rect(bounds.Max.X-margin-width, bottom-height, bounds.Max.X-margin, bottom)
+		draw.DrawMask(img, target, scaled, image.Point{}, opacity, image.Point{}, draw.Over)
+		return
+	}
+
+	text := strings.TrimSpace(p.settings.Watermark.Text)
+	if text == "" {
+		return
+	}
+	face, err := opentype.NewFace(p.font, &opentype.FaceOptions{Size: float64(bounds.Dy()) / 32, DPI: 72})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to create watermark font", "error", err)
+		return
+	}
+	defer face.Close()
+
+	// the text is drawn on its own layer so the opacity applies to it as a whole
+	layer := image.NewRGBA(bounds)
+	drawer := &font.Drawer{Dst: layer, Src: image.White, Face: face}
+	drawer.Dot = fixed.P(bounds.Max.X-margin-drawer.MeasureString(text).Ceil(), bottom-face.Metrics().Descent.Ceil())
+	drawer.DrawString(text)
+	draw.DrawMask(img, bounds, layer, bounds.Min, opacity, image.Point{}, draw.Over)
+}
+
+// clamp limits the value to [low, high]
+func clamp(value float64, low float64, high float64) float64 {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
@@ -5,226 +5,361 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
-	"genImage/config"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sqs"
+	"subvisionCore/description"
+	"subvisionCore/events"
+	"subvisionCore/history"
 )
 
-// Event represents the event data within the MessagePayload
-type Event struct {
-	EventType string `json:"event_type"`
-	UserTier  string `json:"user_tier"`
-	Months    int    `json:"months"`
-	NBits     *int   `json:"n_bits"` // Using pointer to handle null values
-}
-
-// MessagePayload represents the expected structure of messages from the SQS queue
-type MessagePayload struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
-	Datetime string `json:"datetime"`
-	Event    Event  `json:"event"`
-}
+// The messages are defined in the core module, so the services exchanging them share the schema
+type (
+	Event           = events.Event
+	MessagePayload  = events.MessagePayload
+	ImageReadyEvent = events.ImageReadyEvent
+)
 
-// ImageReadyEvent represents the structure of the imageReady event
-type ImageReadyEvent struct {
-	Username  string `json:"username"`
-	ImagePath string `json:"image_path"`
+// Pipeline holds what is needed to process the messages
+type Pipeline struct {
+	Queues      Queues
+	Retry       RetryPolicy
+	Notifier    Notifier
+	Idempotency IdempotencyStore
+	History     history.Store
+	// Descriptions is shared by the workers, so its client and cache are reused by every message
+	Descriptions description.Repository
+	Quota        *QuotaChecker
+	GiftBombs    *GiftBombPolicy
+	Images       ImageProvider
+	PostProcess  *PostProcessor
+	Store        ImageStore
+	// Catalog holds the metadata of the images, apart from the public images
+	Catalog ImageStore
+	// Sinks publish the generated images besides the overlay
+	Sinks Sinks
 }
 
-// ProcessSQSMessages polls the SQS queue for messages and processes them
-func ProcessSQSMessages() {
-	// Get AWS secrets
-	awsSecrets := config.GetAWSSecrets()
-
-	// Initialize AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(awsSecrets.Region),
-		Credentials: credentials.NewStaticCredentials(awsSecrets.AccessKeyID, awsSecrets.SecretAccessKey, ""),
-	})
-
-	if err != nil {
-		log.Printf("Error creating AWS session: %v", err)
-		return
-	}
-
-	// Create SQS service client
-	sqsClient := sqs.New(sess)
-
-	// Set up receive message input
-	receiveParams := &sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(awsSecrets.SubsToProcessSqsQueueURL),
-		MaxNumberOfMessages: aws.Int64(10),
-		WaitTimeSeconds:     aws.Int64(20), // Long polling
-		VisibilityTimeout:   aws.Int64(60), // 60 seconds to process the message
-	}
+// ProcessMessages polls the source queue for messages and processes them on a worker pool until ctx is done.
+// It then stops receiving, releases the messages that were not started and waits for the in-flight ones
+// up to the drain timeout before returning.
+func ProcessMessages(ctx context.Context, pipeline *Pipeline, poolConfig WorkerPoolConfig) {
+	queues := pipeline.Queues
+	pool := NewWorkerPool(poolConfig)
 
-	log.Println("Starting to poll SQS queue for messages...")
+	slog.Info("Starting to poll queue for messages", "workers", pool.config.Workers)
 
 	// Poll for messages
-	for {
-		result, err := sqsClient.ReceiveMessage(receiveParams)
+	for ctx.Err() == nil {
+		// Only receive as many messages as there are free workers,
+		// so no message waits for a worker while its visibility timeout runs
+		free := pool.WaitForSlot(ctx)
+		if free == 0 {
+			break
+		}
+
+		messages, err := queues.Source.Receive(ctx, free)
 		if err != nil {
-			log.Printf("Error receiving message from SQS: %v", err)
-			// message to telegram
-			time.Sleep(5 * time.Second) // Wait before retrying
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Error("Error receiving messages", "error", err)
+			pipeline.Notifier.Notify("receive", fmt.Sprintf("Error receiving messages: %v", err))
+			sleepContext(ctx, 5*time.Second) // Wait before retrying
 			continue
 		}
 
 		// Process received messages
-		for _, message := range result.Messages {
-			processMessage(sqsClient, message, awsSecrets)
+		messagesReceived.Add(float64(len(messages)))
+		// The gift bombs are known before any worker gets the subgift events received with them
+		pipeline.GiftBombs.Register(ctx, messages, pipeline.Quota)
+		for i, message := range messages {
+			if ctx.Err() != nil {
+				// Another instance can process them right away instead of after the visibility timeout
+				releaseMessages(queues.Source, messages[i:])
+				slog.Info("Released unstarted messages", "count", len(messages)-i)
+				break
+			}
+			pool.Submit(queues.Source, message, func(jobs context.Context, message *Message, release func()) {
+				processMessage(jobs, pipeline, message, release)
+			})
 		}
 
 		// Small delay to prevent excessive polling
-		time.Sleep(500 * time.Millisecond)
+		sleepContext(ctx, 500*time.Millisecond)
+	}
+
+	slog.Info("Stopped receiving messages, draining the in-flight ones", "timeout", pool.config.DrainTimeout.String())
+	drained, canceled, abandoned := pool.Drain()
+	for _, message := range abandoned {
+		slog.WarnContext(withJob(context.Background(), originalMessageID(message)), "Abandoned in-flight message, released for redelivery")
+	}
+	slog.Info("Drained in-flight messages", "drained", drained, "canceled", canceled, "abandoned", len(abandoned))
+}
+
+// sleepContext waits for the duration or until ctx is done
+func sleepContext(ctx context.Context, duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
 	}
 }
 
-// processMessage handles a single SQS message
-func processMessage(sqsClient *sqs.SQS, message *sqs.Message, awsSecrets config.AWSSecrets) {
-	log.Printf("Processing message: %s", *message.MessageId)
+// processMessage handles a single queue message, ctx is canceled if the message is abandoned on shutdown.
+// release hands the message back to the worker pool once it is deleted from the queue.
+func processMessage(ctx context.Context, pipeline *Pipeline, message *Message, release func()) {
+	queues := pipeline.Queues
+	// The retries of a message keep the ID of the original one, so they belong to the same job
+	ctx = withJob(ctx, originalMessageID(message))
+
+	// Retried messages wait for their backoff before being processed again
+	if deferIfNotDue(ctx, queues.Source, message) {
+		return
+	}
+
+	slog.InfoContext(ctx, "Processing message", "receipt_message_id", message.ID)
 
 	// Parse message body
 	var payload MessagePayload
-	err := json.Unmarshal([]byte(*message.Body), &payload)
+	err := json.Unmarshal([]byte(message.Body), &payload)
 	if err != nil {
-		log.Printf("Error parsing message body: %v", err)
-		moveMessageToDLQ(sqsClient, message, awsSecrets, "Failed to parse message body")
+		slog.ErrorContext(ctx, "Error parsing message body", "error", err)
+		moveMessageToDLQ(ctx, pipeline, message, "Failed to parse message body")
 		return
 	}
 
 	// Process based on user ID
 	if payload.UserID <= 0 {
-		log.Printf("Message missing or invalid UserID: %s", *message.MessageId)
-		moveMessageToDLQ(sqsClient, message, awsSecrets, "Missing or invalid UserID")
+		slog.ErrorContext(ctx, "Message missing or invalid UserID")
+		moveMessageToDLQ(ctx, pipeline, message, "Missing or invalid UserID")
 		return
 	}
 
-	// Get user description (this would call your user description module)
-	userDescription, err := GetUserDescription(payload.UserID)
+	// A redelivered event reuses the image it already produced instead of generating (and paying for) a new one
+	key := eventKey(payload)
+	ctx = withLogAttrs(ctx, "user_id", payload.UserID, "event_key", key)
+	processed, err := pipeline.Idempotency.Get(key)
 	if err != nil {
-		log.Printf("Failed to get user description: %v", err)
-		moveMessageToDLQ(sqsClient, message, awsSecrets, "Failed to get user description")
+		// Generating twice is better than losing the image, so go on
+		slog.WarnContext(ctx, "Error checking if event was already processed", "error", err)
+	}
+	if processed != nil && processed.SkipReason != "" {
+		// The quota is not checked again, the decision would change as the user gets other images
+		slog.InfoContext(ctx, "Event was already skipped", "reason", processed.SkipReason)
+		// Register saw the redelivered submysterygift as a new gift bomb
+		pipeline.GiftBombs.Cancel(ctx, payload)
+		if err := queues.Source.Ack(ctx, message); err != nil {
+			slog.ErrorContext(ctx, "Error deleting message", "error", err)
+		}
+		return
+	}
+	if processed != nil {
+		slog.InfoContext(ctx, "Event was already processed, reusing its image", "image_path", processed.ImagePath)
+		// The Discord post is only made once the message is deleted, so it is not repeated here
+		completeMessage(ctx, pipeline, message, payload, *processed)
+		return
+	}
+
+	// The subgift events of a gift bomb are part of the image of the gifter. They are coalesced before
+	// the quota is checked, as the quota of the gift bomb was checked when it was registered.
+	if reason := pipeline.GiftBombs.Coalesce(ctx, payload); reason != "" {
+		skipMessage(ctx, pipeline, message, payload, reason)
 		return
 	}
 
-	deleteParams := &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(awsSecrets.SubsToProcessSqsQueueURL),
-		ReceiptHandle: message.ReceiptHandle,
+	// Over-quota events are not failures, they are acknowledged with the reason instead of going to the DLQ
+	releaseQuota, reason := pipeline.Quota.Acquire(ctx, payload)
+	if reason != "" {
+		// Another image of the gifter started since the gift bomb was registered
+		pipeline.GiftBombs.Cancel(ctx, payload)
+		skipMessage(ctx, pipeline, message, payload, reason)
+		return
+	}
+	// Once the image is in the history it is counted from there
+	defer releaseQuota()
+
+	// Get user description (this would call your user description module)
+	descriptionStart := time.Now()
+	userDescription, err := GetUserDescription(ctx, pipeline.Descriptions, payload.UserID)
+	observeStage(stageDescription, descriptionStart)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get user description", "error", err)
+		handleStageFailure(ctx, pipeline, message, stageDescription, err, "Failed to get user description")
+		return
 	}
 
 	// Return if there is no user description
 	if userDescription == "" {
-		log.Printf("No description found for user ID: %d", payload.UserID)
+		slog.InfoContext(ctx, "No description found for user")
 
-		_, err = sqsClient.DeleteMessage(deleteParams)
+		err = queues.Source.Ack(ctx, message)
 		if err != nil {
-			log.Printf("Error deleting message: %v", err)
+			slog.ErrorContext(ctx, "Error deleting message", "error", err)
 		}
 
 		return
 	}
 
-	prompt := createPrompt(userDescription)
+	prompt, err := createPrompt(ctx, userDescription, payload.Event)
+	if err != nil {
+		// The templates are validated at startup, so this is a bug in a template that retrying won't fix
+		slog.ErrorContext(ctx, "Failed to create prompt", "error", err)
+		handleStageFailure(ctx, pipeline, message, stageGeneration, permanentError(err), "Failed to create prompt")
+		return
+	}
+
+	// One line per roll, so the rarity distribution can be computed from the logs
+	slog.InfoContext(ctx, "Rarity roll", "event", payload.Event.EventType, "rarity", prompt.Rarity, "base_prompt", prompt.BasePrompt)
+	rarityRolls.WithLabelValues(prompt.Rarity).Inc()
 
 	// Generate image by calling the GenerateImage module
-	imagePath, err := GenerateImage(prompt, payload.Username)
+	generationStart := time.Now()
+	result, err := GenerateImage(ctx, pipeline.Images, pipeline.PostProcess, pipeline.Store, prompt, payload.Username, key, pipeline.GiftBombs.Variations(payload.Event))
+	observeStage(stageGeneration, generationStart)
 	if err != nil {
-		log.Printf("Failed to generate image: %v", err)
-		moveMessageToDLQ(sqsClient, message, awsSecrets, "Failed to generate image")
+		slog.ErrorContext(ctx, "Failed to generate image", "error", err)
+		pipeline.Notifier.Notify(pipeline.Images.Name(), fmt.Sprintf("Failed to generate image for %s (%s error): %v", payload.Username, errorKind(err), err))
+		handleStageFailure(ctx, pipeline, message, stageGeneration, err, "Failed to generate image")
 		return
 	}
 
-	log.Printf("Image successfully generated and saved to: %s", imagePath)
+	// The lines after the generation carry the task of the image
+	if result.Generated.TaskID != "" {
+		ctx = withTask(ctx, result.Generated.TaskID)
+	}
+	slog.InfoContext(ctx, "Image successfully generated and saved", "image_path", result.ImagePath)
+
+	// The metadata only helps searching the images later, so the message is processed anyway
+	err = saveImageMetadata(ctx, pipeline.Catalog, newImageMetadata(message, payload, prompt, result))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to save image metadata", "image_path", result.ImagePath, "error", err)
+	}
+
+	// Remember the image before anything else can fail, so a redelivery doesn't generate it again
+	processedEvent := newProcessedEvent(key, result.ImagePath, result.ThumbnailPath, prompt.Rarity)
+	err = pipeline.Idempotency.Put(processedEvent)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to record event as processed", "error", err)
+	}
+
+	// The history is only informative, the user got the image anyway
+	err = pipeline.History.Put(ctx, newGeneratedImageRecord(payload, prompt.Rarity, result))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to record image in the history", "image_path", result.ImagePath, "error", err)
+	}
+
+	completeMessage(ctx, pipeline, message, payload, processedEvent)
+	// The message is deleted, its visibility must not be extended anymore and the worker can take another one
+	release()
 
-	// Send imageReady event to ReadyImages.fifo SQS queue
-	err = sendImageReadyEvent(sqsClient, awsSecrets, payload, imagePath)
+	// Publish the image to the sinks once the message is deleted, so the overlay doesn't wait for them.
+	// A shutdown still waits for the uploads, they are canceled with the abandoned messages.
+	pipeline.Sinks.Publish(ctx, newImagePost(payload, prompt, result))
+
+	slog.InfoContext(ctx, "Message processed")
+}
+
+// skipMessage records why the event doesn't get an image and deletes the message from the queue
+func skipMessage(ctx context.Context, pipeline *Pipeline, message *Message, payload MessagePayload, reason string) {
+	key := eventKey(payload)
+	slog.InfoContext(ctx, "Skipping event", "username", payload.Username, "reason", reason)
+
+	err := pipeline.Idempotency.Put(newSkippedEvent(key, reason))
 	if err != nil {
-		log.Printf("Failed to send imageReady event: %v", err)
+		slog.WarnContext(ctx, "Failed to record event as skipped", "error", err)
+	}
+
+	err = pipeline.Queues.Source.Ack(ctx, message)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting message", "error", err)
+	}
+}
+
+// completeMessage sends the imageReady event for the processed event and deletes the message from the queue
+func completeMessage(ctx context.Context, pipeline *Pipeline, message *Message, payload MessagePayload, processed ProcessedEvent) {
+	imageReadyEvent := ImageReadyEvent{
+		Username:  payload.Username,
+		ImagePath: processed.ImagePath,
+		Rarity:    processed.Rarity,
+	}
+
+	// The URLs are resolved now, presigned URLs would expire if stored
+	var err error
+	imageReadyEvent.ImageURL, err = pipeline.Store.URL(processed.ImagePath)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to get the URL of the image", "image_path", processed.ImagePath, "error", err)
+	}
+	if processed.ThumbnailPath != "" {
+		imageReadyEvent.ThumbnailURL, err = pipeline.Store.URL(processed.ThumbnailPath)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to get the URL of the thumbnail", "thumbnail_path", processed.ThumbnailPath, "error", err)
+		}
+	}
+
+	// Send imageReady event to the ReadyImages queue
+	publishStart := time.Now()
+	err = sendImageReadyEvent(ctx, pipeline.Queues.ReadyImages, payload, imageReadyEvent)
+	observeStage(stagePublish, publishStart)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send imageReady event", "error", err)
 		// Note: We don't return here as the image was successfully generated
 		// The failure to send the event shouldn't prevent further processing
 	}
 
 	// Delete message from the queue after successful processing
-	_, err = sqsClient.DeleteMessage(deleteParams)
+	err = pipeline.Queues.Source.Ack(ctx, message)
 	if err != nil {
-		log.Printf("Error deleting message: %v", err)
+		slog.ErrorContext(ctx, "Error deleting message", "error", err)
 	}
-
-	// Send image to Discord (asynchronous, non-blocking)
-	go SendImageToDiscord(imagePath, payload.Username)
-
-	// For now, we'll just log that we would process this message
-	log.Printf("Would process message for UserID: %d", payload.UserID)
 }
 
 // moveMessageToDLQ moves a failed message to the dead letter queue
-func moveMessageToDLQ(sqsClient *sqs.SQS, message *sqs.Message, awsSecrets config.AWSSecrets, reason string) {
-	// send message to telegram
-
-	messageGroupID := "0"
-	// Create deduplication ID to prevent duplicate messages
-	deduplicationID := fmt.Sprintf("%d", time.Now().Unix())
-
-	// Create a new message for the DLQ
-	dlqMessage := *message.Body
-	dlqParams := &sqs.SendMessageInput{
-		MessageBody:  &dlqMessage,
-		QueueUrl:     aws.String(awsSecrets.SubsToProcessSqsDlqQueueURL),
-		MessageGroupId:         aws.String(messageGroupID),
-		MessageDeduplicationId: aws.String(deduplicationID),
-	}
-
-	// Add failure reason as message attribute
-	dlqParams.MessageAttributes = map[string]*sqs.MessageAttributeValue{
-		"FailureReason": {
-			DataType:    aws.String("String"),
-			StringValue: aws.String(reason),
-		},
-		"OriginalMessageID": {
-			DataType:    aws.String("String"),
-			StringValue: message.MessageId,
+func moveMessageToDLQ(ctx context.Context, pipeline *Pipeline, message *Message, reason string) {
+	queues := pipeline.Queues
+	messageFailures.WithLabelValues(reason).Inc()
+	pipeline.Notifier.Notify("dlq:"+reason, fmt.Sprintf("Message %s moved to the DLQ: %s", message.ID, reason))
+
+	// Every message has its own group, a FIFO queue doesn't return more messages of a group
+	// while some are in flight, which would limit the dlq command to 10 messages
+	messageGroupID := originalMessageID(message)
+	// Create deduplication ID to prevent duplicate messages, the time alone would
+	// deduplicate different messages failing in the same second on different workers
+	deduplicationID := fmt.Sprintf("%s_%d", message.ID, time.Now().Unix())
+
+	// Create a new message for the DLQ with the failure reason as attribute
+	dlqMessage := OutgoingMessage{
+		Body:            message.Body,
+		GroupID:         messageGroupID,
+		DeduplicationID: deduplicationID,
+		Attributes: map[string]string{
+			failureReasonAttribute:     reason,
+			originalMessageIDAttribute: originalMessageID(message),
 		},
-		
 	}
 
 	// Send to DLQ
-	_, err := sqsClient.SendMessage(dlqParams)
+	err := queues.DLQ.Publish(dlqMessage)
 	if err != nil {
-		log.Printf("Error sending message to DLQ: %v", err)
+		slog.ErrorContext(ctx, "Error sending message to DLQ", "error", err)
 	} else {
-		log.Printf("Message sent to DLQ: %s, Reason: %s", *message.MessageId, reason)
+		slog.WarnContext(ctx, "Message sent to DLQ", "reason", reason)
 	}
 
 	// Delete the original message from the source queue
-	deleteParams := &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(awsSecrets.SubsToProcessSqsQueueURL),
-		ReceiptHandle: message.ReceiptHandle,
-	}
-
-	_, err = sqsClient.DeleteMessage(deleteParams)
+	err = queues.Source.Ack(ctx, message)
 	if err != nil {
-		log.Printf("Error deleting message after moving to DLQ: %v", err)
+		slog.ErrorContext(ctx, "Error deleting message after moving to DLQ", "error", err)
 	}
 }
 
-// sendImageReadyEvent sends an imageReady event to the ReadyImages.fifo SQS queue
-func sendImageReadyEvent(sqsClient *sqs.SQS, awsSecrets config.AWSSecrets, payload MessagePayload, imagePath string) error {
-	// Create the imageReady event
-	imageReadyEvent := ImageReadyEvent{
-		Username:      payload.Username,
-		ImagePath:     imagePath,
-	}
-
+// sendImageReadyEvent publishes an imageReady event to the ReadyImages queue
+func sendImageReadyEvent(ctx context.Context, sink MessageSink, payload MessagePayload, imageReadyEvent ImageReadyEvent) error {
 	// Marshal the event to JSON
 	eventJSON, err := json.Marshal(imageReadyEvent)
 	if err != nil {
@@ -232,23 +367,21 @@ func sendImageReadyEvent(sqsClient *sqs.SQS, awsSecrets config.AWSSecrets, paylo
 	}
 
 	messageGroupID := "0"
-	
-	// Create deduplication ID to prevent duplicate messages
-	deduplicationID := fmt.Sprintf("%d_%s_%d", payload.UserID, payload.Event.EventType, time.Now().Unix())
 
-	// Send message to ReadyImages.fifo queue
-	sendParams := &sqs.SendMessageInput{
-		MessageBody:            aws.String(string(eventJSON)),
-		QueueUrl:               aws.String(awsSecrets.ReadyImagesSqsQueueURL),
-		MessageGroupId:         aws.String(messageGroupID),
-		MessageDeduplicationId: aws.String(deduplicationID),
-	}
+	// Create deduplication ID from the source event, so the event sent again
+	// for a redelivered message is dropped by the FIFO deduplication
+	deduplicationID := eventKey(payload)
 
-	_, err = sqsClient.SendMessage(sendParams)
+	// Publish to the ReadyImages queue
+	err = sink.Publish(OutgoingMessage{
+		Body:            string(eventJSON),
+		GroupID:         messageGroupID,
+		DeduplicationID: deduplicationID,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to send imageReady event to SQS: %v", err)
+		return fmt.Errorf("failed to send imageReady event: %v", err)
 	}
 
-	log.Printf("Successfully sent imageReady event to ReadyImages.fifo queue for user %d", payload.UserID)
+	slog.InfoContext(ctx, "Successfully sent imageReady event to ReadyImages queue")
 	return nil
 }
@@ -0,0 +1,195 @@
+// this module parses the base prompt templates of prompt_data.json and validates them at startup,
+// so a typo in a template or an empty list fails loudly instead of leaking into the prompts
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// BasePrompt is a text/template used to build the prompt, chosen randomly by weight
+type BasePrompt struct {
+	Name     string `json:"name"`
+	Weight   int    `json:"weight"`
+	Template string `json:"template"`
+	// EventTypes restricts the base prompt to these event types, it is used for every event if empty
+	EventTypes []string `json:"event_types"`
+
+	parsed *template.Template
+}
+
+// PromptTemplateData is the data available to the base prompt templates
+type PromptTemplateData struct {
+	UserDescription string
+	Background      string
+	Emotion         string
+	ActionOrSign    string
+	EventType       string
+	UserTier        string
+	Months          int
+	Bits            int
+	GiftCount       int
+	EventModifiers  []string
+	Rarity          string
+	RarityPrompt    string
+}
+
+// templateFieldLists maps the template fields to the prompt_data.json lists they are rolled from
+var templateFieldLists = map[string][]string{
+	"Background":   {"backgrounds"},
+	"Emotion":      {"emotions"},
+	"ActionOrSign": {"actions", "sign_texts"},
+	"Rarity":       {"rarities"},
+	"RarityPrompt": {"rarities"},
+}
+
+// sampleTemplateData is used to execute the templates once at load time,
+// which catches references to fields that don't exist
+var sampleTemplateData = PromptTemplateData{
+	UserDescription: "a person",
+	Background:      "a background",
+	Emotion:         "an emotion",
+	ActionOrSign:    "an action",
+	EventType:       "sub",
+	UserTier:        "Tier1",
+	Months:          1,
+	EventModifiers:  []string{"a modifier"},
+	Rarity:          "common",
+}
+
+// forEvent reports whether the base prompt is dedicated to the event type
+func (b *BasePrompt) forEvent(eventType string) bool {
+	for _, t := range b.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// render executes the template with the given data
+func (b *BasePrompt) render(data PromptTemplateData) (string, error) {
+	var prompt strings.Builder
+	if err := b.parsed.Execute(&prompt, data); err != nil {
+		return "", err
+	}
+	return prompt.String(), nil
+}
+
+// validatePromptData parses the base prompt templates and checks that what they reference is configured
+func validatePromptData(data *PromptData) error {
+	if len(data.BasePrompts) == 0 {
+		return fmt.Errorf("base_prompts is empty")
+	}
+
+	lists := map[string]int{
+		"backgrounds": len(data.Backgrounds),
+		"emotions":    len(data.Emotions),
+		"actions":     len(data.Actions),
+		"sign_texts":  len(data.SignTexts),
+		"rarities":    len(data.Rarities),
+	}
+
+	totalWeight := 0
+	for i := range data.BasePrompts {
+		basePrompt := &data.BasePrompts[i]
+		if basePrompt.Name == "" {
+			basePrompt.Name = fmt.Sprintf("base_prompts[%d]", i)
+		}
+		if basePrompt.Weight < 0 {
+			return fmt.Errorf("base prompt %q: weight must not be negative", basePrompt.Name)
+		}
+		// the generic base prompts must be enough for any event, the dedicated ones are optional
+		if len(basePrompt.EventTypes) == 0 {
+			totalWeight += basePrompt.Weight
+		}
+
+		parsed, err := template.New(basePrompt.Name).Option("missingkey=error").Parse(basePrompt.Template)
+		if err != nil {
+			return fmt.Errorf("base prompt %q: %w", basePrompt.Name, err)
+		}
+		basePrompt.parsed = parsed
+
+		for _, field := range templateFields(parsed) {
+			for _, list := range templateFieldLists[field] {
+				if lists[list] == 0 {
+					return fmt.Errorf("base prompt %q uses .%s but %s is empty", basePrompt.Name, field, list)
+				}
+			}
+		}
+
+		if _, err := basePrompt.render(sampleTemplateData); err != nil {
+			return fmt.Errorf("base prompt %q: %w", basePrompt.Name, err)
+		}
+	}
+	if totalWeight == 0 {
+		return fmt.Errorf("base_prompts: at least one weight of a base prompt without event_types must be positive")
+	}
+
+	for _, rarity := range data.Rarities {
+		if rarity.Name == "" {
+			return fmt.Errorf("rarities: every rarity needs a name")
+		}
+		if rarity.Weight < 0 {
+			return fmt.Errorf("rarity %q: weight must not be negative", rarity.Name)
+		}
+	}
+
+	return nil
+}
+
+// templateFields returns the names of the top level fields referenced by the template, like .Background
+func templateFields(t *template.Template) []string {
+	var fields []string
+	seen := make(map[string]bool)
+
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, child := range n.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, command := range n.Cmds {
+				walk(command)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			if name := n.Ident[0]; !seen[name] {
+				seen[name] = true
+				fields = append(fields, name)
+			}
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			// fields inside a range refer to the element, only the ranged pipe is top level
+			walk(n.Pipe)
+		case *parse.WithNode:
+			walk(n.Pipe)
+		}
+	}
+
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			walk(tmpl.Tree.Root)
+		}
+	}
+	return fields
+}
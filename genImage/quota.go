@@ -0,0 +1,226 @@
+// this module limits how many images a user gets, so a user who resubs and cheers many times in a row
+// doesn't flood the overlay and the Runware bill. The generations are counted from the history store.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"subvisionCore/history"
+)
+
+// QuotaSettings are the limits on the generations, zero values disable a limit
+type QuotaSettings struct {
+	// AllowedEventTypes are the event types generating an image, every type if empty
+	AllowedEventTypes []string `json:"allowed_event_types"`
+	// MinIntervalSeconds is the minimum time between two images of the same user
+	MinIntervalSeconds int `json:"min_interval_seconds"`
+	// MaxPerStream is the maximum number of images of a user in the last StreamHours
+	MaxPerStream int `json:"max_per_stream"`
+	StreamHours  int `json:"stream_hours"`
+	// MaxPerDay is the maximum number of images of a user in the last 24 hours
+	MaxPerDay int `json:"max_per_day"`
+}
+
+// DefaultQuotaSettings returns the limits used when settings.json doesn't configure them
+func DefaultQuotaSettings() QuotaSettings {
+	return QuotaSettings{
+		AllowedEventTypes:  []string{"sub", "resub", "subgift", "submysterygift", "bits"},
+		MinIntervalSeconds: 30,
+		MaxPerStream:       5,
+		StreamHours:        8,
+		MaxPerDay:          10,
+	}
+}
+
+// QuotaChecker decides whether an event may generate an image. The generations being processed
+// are not in the history yet, so they are tracked in memory to be counted as well.
+type QuotaChecker struct {
+	settings QuotaSettings
+	history  history.Store
+
+	// mu only guards the users map, each user is checked under its own lock
+	// so a slow history query doesn't hold up the events of the other users
+	mu    sync.Mutex
+	users map[int]*userQuota
+}
+
+// userQuota is the state of a user with events being checked or generations in flight
+type userQuota struct {
+	mu       sync.Mutex
+	inFlight []time.Time
+	// refs is the number of goroutines holding or waiting for mu, guarded by QuotaChecker.mu
+	refs int
+}
+
+// NewQuotaChecker returns a checker counting the generations in the history
+func NewQuotaChecker(settings QuotaSettings, store history.Store) *QuotaChecker {
+	return &QuotaChecker{
+		settings: settings,
+		history:  store,
+		users:    make(map[int]*userQuota),
+	}
+}
+
+// Acquire checks the limits for the event. If the event is over quota it returns the reason,
+// otherwise the generation is counted until release is called, once it is in the history or it failed.
+func (q *QuotaChecker) Acquire(ctx context.Context, payload MessagePayload) (release func(), reason string) {
+	if !q.eventTypeAllowed(payload.Event.EventType) {
+		return nil, fmt.Sprintf("event type %s is not allowed", payload.Event.EventType)
+	}
+
+	// The check and the reservation are atomic, or concurrent events of a user would all pass
+	user := q.lockUser(payload.UserID)
+	defer q.unlockUser(payload.UserID, user)
+
+	now := time.Now()
+	if reason := q.check(ctx, payload.UserID, user, now); reason != "" {
+		return nil, reason
+	}
+
+	user.inFlight = append(user.inFlight, now)
+	return func() { q.release(payload.UserID, now) }, ""
+}
+
+// Check returns why the event is over quota, empty if it is not, without counting a generation.
+// The event can still be over quota when it is acquired, if another generation of the user started in between.
+func (q *QuotaChecker) Check(ctx context.Context, payload MessagePayload) string {
+	if !q.eventTypeAllowed(payload.Event.EventType) {
+		return fmt.Sprintf("event type %s is not allowed", payload.Event.EventType)
+	}
+
+	user := q.lockUser(payload.UserID)
+	defer q.unlockUser(payload.UserID, user)
+
+	return q.check(ctx, payload.UserID, user, time.Now())
+}
+
+// check returns why a new generation of the user would exceed a limit, the caller must hold the lock of the user
+func (q *QuotaChecker) check(ctx context.Context, userID int, user *userQuota, now time.Time) string {
+	times, err := q.recentGenerations(ctx, userID, user, now)
+	if err != nil {
+		// Generating too much is better than not generating at all
+		slog.WarnContext(ctx, "Failed to check the quota of the user, allowing the event", "error", err)
+		return ""
+	}
+	return q.overQuota(times, now)
+}
+
+// lockUser returns the state of the user once its lock is held
+func (q *QuotaChecker) lockUser(userID int) *userQuota {
+	q.mu.Lock()
+	user, ok := q.users[userID]
+	if !ok {
+		user = &userQuota{}
+		q.users[userID] = user
+	}
+	user.refs++
+	q.mu.Unlock()
+
+	user.mu.Lock()
+	return user
+}
+
+// unlockUser releases the lock of the user, forgetting the user once nothing is left to count
+func (q *QuotaChecker) unlockUser(userID int, user *userQuota) {
+	q.mu.Lock()
+	user.refs--
+	if user.refs == 0 && len(user.inFlight) == 0 {
+		delete(q.users, userID)
+	}
+	q.mu.Unlock()
+
+	user.mu.Unlock()
+}
+
+// eventTypeAllowed reports whether the event type is in the allowlist
+func (q *QuotaChecker) eventTypeAllowed(eventType string) bool {
+	if len(q.settings.AllowedEventTypes) == 0 {
+		return true
+	}
+	for _, allowed := range q.settings.AllowedEventTypes {
+		if allowed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// window returns how far back the generations are counted
+func (q *QuotaChecker) window() time.Duration {
+	window := time.Duration(q.settings.MinIntervalSeconds) * time.Second
+	if q.settings.MaxPerStream > 0 && time.Duration(q.settings.StreamHours)*time.Hour > window {
+		window = time.Duration(q.settings.StreamHours) * time.Hour
+	}
+	if q.settings.MaxPerDay > 0 && 24*time.Hour > window {
+		window = 24 * time.Hour
+	}
+	return window
+}
+
+// recentGenerations returns the times of the generations of the user in the window, in the history or in flight
+func (q *QuotaChecker) recentGenerations(ctx context.Context, userID int, user *userQuota, now time.Time) ([]time.Time, error) {
+	window := q.window()
+	if window == 0 {
+		return nil, nil
+	}
+
+	records, err := q.history.List(ctx, history.Query{UserID: userID, Since: now.Add(-window)})
+	if err != nil {
+		return nil, err
+	}
+
+	times := append([]time.Time(nil), user.inFlight...)
+	for _, record := range records {
+		createdAt, err := time.Parse(time.RFC3339Nano, record.CreatedAt)
+		if err != nil {
+			continue
+		}
+		times = append(times, createdAt)
+	}
+	return times, nil
+}
+
+// overQuota returns why a new generation would exceed a limit, empty if it doesn't
+func (q *QuotaChecker) overQuota(times []time.Time, now time.Time) string {
+	minInterval := time.Duration(q.settings.MinIntervalSeconds) * time.Second
+	streamWindow := time.Duration(q.settings.StreamHours) * time.Hour
+
+	perStream, perDay := 0, 0
+	for _, t := range times {
+		if minInterval > 0 && now.Sub(t) < minInterval {
+			return fmt.Sprintf("less than %s since the previous image", minInterval)
+		}
+		if now.Sub(t) < streamWindow {
+			perStream++
+		}
+		if now.Sub(t) < 24*time.Hour {
+			perDay++
+		}
+	}
+
+	if q.settings.MaxPerStream > 0 && perStream >= q.settings.MaxPerStream {
+		return fmt.Sprintf("already %d images in the last %d hours", perStream, q.settings.StreamHours)
+	}
+	if q.settings.MaxPerDay > 0 && perDay >= q.settings.MaxPerDay {
+		return fmt.Sprintf("already %d images in the last 24 hours", perDay)
+	}
+	return ""
+}
+
+// release stops counting the generation in flight
+func (q *QuotaChecker) release(userID int, reserved time.Time) {
+	user := q.lockUser(userID)
+	defer q.unlockUser(userID, user)
+
+	for i, t := range user.inFlight {
+		if t.Equal(reserved) {
+			user.inFlight = append(user.inFlight[:i], user.inFlight[i+1:]...)
+			break
+		}
+	}
+}
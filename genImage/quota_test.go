@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"subvisionCore/history"
+)
+
+// failingHistory is a history store whose queries fail
+type failingHistory struct {
+	*history.MemoryStore
+}
+
+func (failingHistory) List(ctx context.Context, query history.Query) ([]history.Record, error) {
+	return nil, errors.New("list failed")
+}
+
+// newTestQuota returns a checker over a history holding an image of the user for each age
+func newTestQuota(t *testing.T, settings QuotaSettings, userID int, ages ...time.Duration) *QuotaChecker {
+	t.Helper()
+	store := history.NewMemoryStore()
+	for _, age := range ages {
+		record := history.Record{UserID: userID, CreatedAt: history.FormatTime(time.Now().Add(-age))}
+		if err := store.Put(context.Background(), record); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	return NewQuotaChecker(settings, store)
+}
+
+// quotaPayload returns the payload of an event of the user
+func quotaPayload(userID int, eventType string) MessagePayload {
+	return MessagePayload{UserID: userID, Username: "user", Event: Event{EventType: eventType}}
+}
+
+func TestQuotaCheckerAcquire(t *testing.T) {
+	settings := DefaultQuotaSettings()
+
+	tests := []struct {
+		name     string
+		settings QuotaSettings
+		// ages are the ages of the images of user 1 in the history
+		ages          []time.Duration
+		payload       MessagePayload
+		wantOverQuota bool
+	}{
+		{name: "first image", settings: settings, payload: quotaPayload(1, "sub")},
+		{name: "event type not allowed", settings: settings, payload: quotaPayload(1, "follow"), wantOverQuota: true},
+		{name: "every event type allowed without allowlist", settings: QuotaSettings{}, payload: quotaPayload(1, "follow")},
+		{name: "within the minimum interval", settings: settings, ages: []time.Duration{10 * time.Second}, payload: quotaPayload(1, "sub"), wantOverQuota: true},
+		{name: "after the minimum interval", settings: settings, ages: []time.Duration{time.Minute}, payload: quotaPayload(1, "sub")},
+		{
+			name:          "per stream limit",
+			settings:      settings,
+			ages:          []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour, 4 * time.Hour, 5 * time.Hour},
+			payload:       quotaPayload(1, "sub"),
+			wantOverQuota: true,
+		},
+		{
+			name:     "images before the stream are not counted in it",
+			settings: settings,
+			ages:     []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour, 4 * time.Hour, 9 * time.Hour},
+			payload:  quotaPayload(1, "sub"),
+		},
+		{
+			name:          "per day limit",
+			settings:      QuotaSettings{MaxPerDay: 2},
+			ages:          []time.Duration{time.Hour, 20 * time.Hour},
+			payload:       quotaPayload(1, "sub"),
+			wantOverQuota: true,
+		},
+		{
+			name:     "images before the day are not counted",
+			settings: QuotaSettings{MaxPerDay: 2},
+			ages:     []time.Duration{time.Hour, 25 * time.Hour},
+			payload:  quotaPayload(1, "sub"),
+		},
+		{name: "images of other users are not counted", settings: settings, ages: []time.Duration{time.Second}, payload: quotaPayload(2, "sub")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quota := newTestQuota(t, tt.settings, 1, tt.ages...)
+
+			if reason := quota.Check(context.Background(), tt.payload); (reason != "") != tt.wantOverQuota {
+				t.Errorf("Check() = %q, want over quota %v", reason, tt.wantOverQuota)
+			}
+			release, reason := quota.Acquire(context.Background(), tt.payload)
+			if (reason != "") != tt.wantOverQuota {
+				t.Errorf("Acquire() = %q, want over quota %v", reason, tt.wantOverQuota)
+			}
+			if release != nil {
+				release()
+			}
+		})
+	}
+}
+
+func TestQuotaCheckerCountsInFlight(t *testing.T) {
+	quota := newTestQuota(t, QuotaSettings{MaxPerStream: 2, StreamHours: 8}, 1)
+	ctx := context.Background()
+	payload := quotaPayload(1, "sub")
+
+	// Check doesn't count a generation
+	for i := 0; i < 3; i++ {
+		if reason := quota.Check(ctx, payload); reason != "" {
+			t.Fatalf("Check() = %q, want under quota", reason)
+		}
+	}
+
+	first, reason := quota.Acquire(ctx, payload)
+	if reason != "" {
+		t.Fatalf("first Acquire() = %q, want under quota", reason)
+	}
+	second, reason := quota.Acquire(ctx, payload)
+	if reason != "" {
+		t.Fatalf("second Acquire() = %q, want under quota", reason)
+	}
+	if _, reason := quota.Acquire(ctx, payload); reason == "" {
+		t.Error("Acquire() with 2 generations in flight is under quota, want over quota")
+	}
+	if reason := quota.Check(ctx, payload); reason == "" {
+		t.Error("Check() with 2 generations in flight is under quota, want over quota")
+	}
+
+	first()
+	third, reason := quota.Acquire(ctx, payload)
+	if reason != "" {
+		t.Errorf("Acquire() after a release = %q, want under quota", reason)
+	}
+
+	second()
+	third()
+	if len(quota.users) != 0 {
+		t.Errorf("users = %d after every release, want them forgotten", len(quota.users))
+	}
+}
+
+func TestQuotaCheckerConcurrentAcquire(t *testing.T) {
+	quota := newTestQuota(t, QuotaSettings{MinIntervalSeconds: 30}, 1)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	acquired := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, reason := quota.Acquire(context.Background(), quotaPayload(1, "sub")); reason == "" {
+				mu.Lock()
+				acquired++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if acquired != 1 {
+		t.Errorf("%d concurrent Acquire() under quota, want 1", acquired)
+	}
+}
+
+func TestQuotaCheckerAllowsWhenHistoryFails(t *testing.T) {
+	quota := NewQuotaChecker(DefaultQuotaSettings(), failingHistory{history.NewMemoryStore()})
+
+	release, reason := quota.Acquire(context.Background(), quotaPayload(1, "sub"))
+	if reason != "" {
+		t.Fatalf("Acquire() = %q, want the event allowed", reason)
+	}
+	release()
+}
@@ -0,0 +1,270 @@
+// this module classifies the pipeline errors as transient or permanent and decides
+// if a failed message is retried later or moved to the dlq
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// ErrorKind tells if a failed operation is worth retrying
+type ErrorKind int
+
+const (
+	// Transient errors, like throttling or 5xx responses, may succeed on a later attempt
+	Transient ErrorKind = iota
+	// Permanent errors, like a prompt rejected by the provider, fail on every attempt
+	Permanent
+)
+
+func (k ErrorKind) String() string {
+	if k == Permanent {
+		return "permanent"
+	}
+	return "transient"
+}
+
+// ClassifiedError is an error annotated with its ErrorKind
+type ClassifiedError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *ClassifiedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClassifiedError) Unwrap() error {
+	return e.Err
+}
+
+// transientError marks err as transient
+func transientError(err error) error {
+	return &ClassifiedError{Kind: Transient, Err: err}
+}
+
+// permanentError marks err as permanent
+func permanentError(err error) error {
+	return &ClassifiedError{Kind: Permanent, Err: err}
+}
+
+// errorKind returns the kind of err, errors that were not classified are considered transient
+func errorKind(err error) ErrorKind {
+	var classified *ClassifiedError
+	if errors.As(err, &classified) {
+		return classified.Kind
+	}
+	return Transient
+}
+
+// httpStatusError builds an error for an unexpected HTTP status,
+// rate limiting and server errors are transient, the other client errors are permanent
+func httpStatusError(statusCode int, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout || statusCode >= 500 {
+		return transientError(err)
+	}
+	return permanentError(err)
+}
+
+// classifyAWSError classifies an error returned by the AWS SDK
+func classifyAWSError(err error) error {
+	// the SDK helpers don't unwrap, so they must be given the AWS error itself
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return transientError(err)
+	}
+	if request.IsErrorRetryable(awsErr) || request.IsErrorThrottle(awsErr) {
+		return transientError(err)
+	}
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) && requestFailure.StatusCode() < 500 {
+		return permanentError(err)
+	}
+	return transientError(err)
+}
+
+// pipeline stages that can be retried
+const (
+	stageDescription = "description"
+	stageGeneration  = "generation"
+)
+
+const (
+	// failureReasonAttribute holds why a message was moved to the DLQ
+	failureReasonAttribute = "FailureReason"
+	// notBeforeAttribute holds the time before which a retried message must not be processed
+	notBeforeAttribute = "NotBefore"
+	// originalMessageIDAttribute holds the ID of the first delivery of a retried message
+	originalMessageIDAttribute = "OriginalMessageID"
+)
+
+// attemptsAttribute returns the message attribute holding the attempts made for a stage
+func attemptsAttribute(stage string) string {
+	return strings.ToUpper(stage[:1]) + stage[1:] + "Attempts"
+}
+
+// messageAttempts returns the number of attempts already made for a stage
+func messageAttempts(message *Message, stage string) int {
+	attempts, err := strconv.Atoi(message.Attributes[attemptsAttribute(stage)])
+	if err != nil {
+		return 0
+	}
+	return attempts
+}
+
+// originalMessageID returns the ID of the first delivery of the message
+func originalMessageID(message *Message) string {
+	if id := message.Attributes[originalMessageIDAttribute]; id != "" {
+		return id
+	}
+	return message.ID
+}
+
+// RetryPolicy configures how failed stages are retried
+type RetryPolicy struct {
+	// BaseDelaySeconds is the delay before the first retry, doubled on every attempt
+	BaseDelaySeconds int `json:"base_delay_seconds"`
+	// MaxDelaySeconds caps the delay between two attempts, 0 means no cap
+	MaxDelaySeconds int `json:"max_delay_seconds"`
+	// MaxAttempts is the number of attempts per stage, including the first one
+	MaxAttempts map[string]int `json:"max_attempts"`
+}
+
+// DefaultRetryPolicy returns the retry policy used when settings.json doesn't define one
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		BaseDelaySeconds: 5,
+		MaxDelaySeconds:  300,
+		MaxAttempts: map[string]int{
+			stageDescription: 5,
+			stageGeneration:  3,
+		},
+	}
+}
+
+// maxAttempts returns the number of attempts allowed for a stage, a stage that is not configured is not retried
+func (p RetryPolicy) maxAttempts(stage string) int {
+	if attempts, ok := p.MaxAttempts[stage]; ok && attempts > 0 {
+		return attempts
+	}
+	return 1
+}
+
+// Backoff returns the delay before the given attempt (1 is the first retry),
+// exponential with jitter so retries of a burst of failures are spread out
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	base := time.Duration(p.BaseDelaySeconds) * time.Second
+	maxDelay := time.Duration(p.MaxDelaySeconds) * time.Second
+	if base <= 0 {
+		return 0
+	}
+
+	delay := base
+	for i := 1; i < attempt && (maxDelay <= 0 || delay < maxDelay) && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+
+	// half of the delay is fixed, the other half is random
+	half := delay / 2
+	return half + time.Duration(rng.Intn(int(half/time.Millisecond)+1))*time.Millisecond
+}
+
+// handleStageFailure retries the message later if the error is transient and the stage has attempts left,
+// otherwise it moves the message to the DLQ with the given reason
+func handleStageFailure(ctx context.Context, pipeline *Pipeline, message *Message, stage string, err error, reason string) {
+	// An abandoned message was already released, it is processed again from the start
+	if ctx.Err() != nil {
+		slog.WarnContext(ctx, "Message abandoned during shutdown", "stage", stage, "error", err)
+		return
+	}
+
+	attempts := messageAttempts(message, stage) + 1
+	maxAttempts := pipeline.Retry.maxAttempts(stage)
+	kind := errorKind(err)
+
+	if kind == Permanent || attempts >= maxAttempts {
+		slog.WarnContext(ctx, "Giving up on message", "stage", stage, "attempts", attempts, "max_attempts", maxAttempts, "error_kind", kind.String())
+		moveMessageToDLQ(ctx, pipeline, message, reason)
+		return
+	}
+
+	delay := pipeline.Retry.Backoff(attempts)
+	err = retryMessage(ctx, pipeline.Queues, message, stage, attempts, delay)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error scheduling retry of message", "error", err)
+		moveMessageToDLQ(ctx, pipeline, message, reason)
+		return
+	}
+
+	slog.InfoContext(ctx, "Message failed, retrying later", "stage", stage, "attempt", attempts, "max_attempts", maxAttempts, "delay", delay.Round(time.Second).String())
+}
+
+// retryMessage publishes a copy of the message with the updated attempts and the time it can be
+// processed again, then deletes the original. Keeping the state in the message attributes makes
+// the retry survive a restart of the service.
+func retryMessage(ctx context.Context, queues Queues, message *Message, stage string, attempts int, delay time.Duration) error {
+	attributes := make(map[string]string, len(message.Attributes)+3)
+	for name, value := range message.Attributes {
+		attributes[name] = value
+	}
+	attributes[attemptsAttribute(stage)] = strconv.Itoa(attempts)
+	attributes[notBeforeAttribute] = time.Now().Add(delay).UTC().Format(time.RFC3339)
+	attributes[originalMessageIDAttribute] = originalMessageID(message)
+
+	// A deferred message blocks its FIFO message group while it is hidden,
+	// so every retried message gets a group of its own to not hold back the new events
+	err := queues.Retry.Publish(OutgoingMessage{
+		Body:            message.Body,
+		GroupID:         "retry_" + originalMessageID(message),
+		DeduplicationID: fmt.Sprintf("%s_%s_%d", originalMessageID(message), stage, attempts),
+		Attributes:      attributes,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = queues.Source.Ack(ctx, message)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting message after scheduling retry", "error", err)
+	}
+	return nil
+}
+
+// deferIfNotDue hides a retried message until its NotBefore time, it returns true if the message was deferred
+func deferIfNotDue(ctx context.Context, source MessageSource, message *Message) bool {
+	notBefore, err := time.Parse(time.RFC3339, message.Attributes[notBeforeAttribute])
+	if err != nil {
+		return false
+	}
+
+	wait := time.Until(notBefore)
+	if wait <= 0 {
+		return false
+	}
+
+	// round up, visibility timeouts have a granularity of one second
+	wait = wait.Truncate(time.Second) + time.Second
+	err = source.ExtendVisibility(ctx, message, wait)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deferring message", "error", err)
+		return false
+	}
+
+	slog.InfoContext(ctx, "Message is scheduled for retry, deferred", "wait", wait.String())
+	return true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{name: "unclassified errors are transient", err: errors.New("boom"), want: Transient},
+		{name: "transient", err: transientError(errors.New("boom")), want: Transient},
+		{name: "permanent", err: permanentError(errors.New("boom")), want: Permanent},
+		{name: "wrapped permanent", err: fmt.Errorf("stage failed: %w", permanentError(errors.New("boom"))), want: Permanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorKind(tt.err); got != tt.want {
+				t.Errorf("errorKind() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifiedErrorUnwraps(t *testing.T) {
+	cause := errors.New("boom")
+	err := permanentError(cause)
+
+	if !errors.Is(err, cause) {
+		t.Error("errors.Is() doesn't find the cause of the classified error")
+	}
+	if err.Error() != "boom" {
+		t.Errorf("Error() = %q, want the message of the cause", err.Error())
+	}
+}
+
+func TestHTTPStatusError(t *testing.T) {
+	tests := []struct {
+		status int
+		want   ErrorKind
+	}{
+		{status: 429, want: Transient},
+		{status: 408, want: Transient},
+		{status: 500, want: Transient},
+		{status: 503, want: Transient},
+		{status: 400, want: Permanent},
+		{status: 401, want: Permanent},
+		{status: 404, want: Permanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.status), func(t *testing.T) {
+			err := httpStatusError(tt.status, "API returned status %d", tt.status)
+			if got := errorKind(err); got != tt.want {
+				t.Errorf("errorKind() = %s, want %s", got, tt.want)
+			}
+			if want := fmt.Sprintf("API returned status %d", tt.status); err.Error() != want {
+				t.Errorf("Error() = %q, want %q", err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestClassifyAWSError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{name: "not an AWS error", err: errors.New("connection reset"), want: Transient},
+		{name: "throttling", err: awserr.New("ThrottlingException", "slow down", nil), want: Transient},
+		{
+			name: "client error",
+			err:  awserr.NewRequestFailure(awserr.New("ValidationException", "invalid key", nil), 400, "request"),
+			want: Permanent,
+		},
+		{
+			name: "wrapped client error",
+			err:  fmt.Errorf("failed to get item: %w", awserr.NewRequestFailure(awserr.New("AccessDeniedException", "denied", nil), 403, "request")),
+			want: Permanent,
+		},
+		{
+			name: "server error",
+			err:  awserr.NewRequestFailure(awserr.New("InternalServerError", "oops", nil), 500, "request"),
+			want: Transient,
+		},
+		{
+			name: "throttled request",
+			err:  awserr.NewRequestFailure(awserr.New("ProvisionedThroughputExceededException", "slow down", nil), 400, "request"),
+			want: Transient,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorKind(classifyAWSError(tt.err)); got != tt.want {
+				t.Errorf("errorKind(classifyAWSError()) = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		// the delay is between half of want and want, because of the jitter
+		want time.Duration
+	}{
+		{name: "first retry", policy: RetryPolicy{BaseDelaySeconds: 5, MaxDelaySeconds: 300}, attempt: 1, want: 5 * time.Second},
+		{name: "doubled on every attempt", policy: RetryPolicy{BaseDelaySeconds: 5, MaxDelaySeconds: 300}, attempt: 3, want: 20 * time.Second},
+		{name: "capped", policy: RetryPolicy{BaseDelaySeconds: 5, MaxDelaySeconds: 300}, attempt: 10, want: 300 * time.Second},
+		{name: "no cap", policy: RetryPolicy{BaseDelaySeconds: 5}, attempt: 4, want: 40 * time.Second},
+		{name: "no cap with many attempts doesn't overflow", policy: RetryPolicy{BaseDelaySeconds: 5}, attempt: 100, want: 5 * time.Second << 30},
+		{name: "no base delay", policy: RetryPolicy{MaxDelaySeconds: 300}, attempt: 3, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				got := tt.policy.Backoff(tt.attempt)
+				if got < tt.want/2 || got > tt.want {
+					t.Fatalf("Backoff(%d) = %s, want between %s and %s", tt.attempt, got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeferIfNotDue(t *testing.T) {
+	tests := []struct {
+		name      string
+		notBefore string
+		want      bool
+	}{
+		{name: "not retried", notBefore: "", want: false},
+		{name: "invalid time", notBefore: "tomorrow", want: false},
+		{name: "due", notBefore: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339), want: false},
+		{name: "not due", notBefore: time.Now().Add(time.Minute).UTC().Format(time.RFC3339), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewMemoryQueue()
+			q.SetWaitTime(0)
+			attributes := map[string]string{}
+			if tt.notBefore != "" {
+				attributes[notBeforeAttribute] = tt.notBefore
+			}
+			q.Publish(OutgoingMessage{Body: "event", Attributes: attributes})
+			message := receive(t, q, 1)[0]
+			// the message is visible again right away unless it is deferred
+			q.Nack(context.Background(), message)
+
+			if got := deferIfNotDue(context.Background(), q, message); got != tt.want {
+				t.Errorf("deferIfNotDue() = %v, want %v", got, tt.want)
+			}
+			if visible := len(receive(t, q, 1)) == 1; visible == tt.want {
+				t.Errorf("message visible = %v after deferIfNotDue() = %v", visible, tt.want)
+			}
+		})
+	}
+}
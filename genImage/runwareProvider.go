@@ -0,0 +1,145 @@
+// this module generates the images with the Runware API and downloads them
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	runwareProviderName = "runware"
+	runwareAPIURL       = "https://api.runware.ai/v1"
+)
+
+// RunwareProvider is an ImageProvider using the Runware imageInference task
+type RunwareProvider struct {
+	client *http.Client
+	apiKey string
+	apiURL string
+}
+
+// NewRunwareProvider returns a provider authenticated with the API key
+func NewRunwareProvider(apiKey string) *RunwareProvider {
+	return &RunwareProvider{
+		client: &http.Client{Timeout: 60 * time.Second},
+		apiKey: apiKey,
+		apiURL: runwareAPIURL,
+	}
+}
+
+// Name returns the name of the provider
+func (p *RunwareProvider) Name() string {
+	return runwareProviderName
+}
+
+// Generate asks Runware to generate the image and downloads it
+func (p *RunwareProvider) Generate(ctx context.Context, request ImageRequest) (*GeneratedImage, error) {
+	taskUUID := uuid.New().String()
+	ctx = withTask(ctx, taskUUID)
+	slog.InfoContext(ctx, "Requesting image from Runware", "model", request.Model.ID)
+
+	imageURL, err := p.requestImage(ctx, taskUUID, request)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := p.download(ctx, imageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := imageFormat(data)
+	if err != nil {
+		return nil, permanentError(fmt.Errorf("runware returned an invalid image: %w", err))
+	}
+	slog.InfoContext(ctx, "Downloaded image from Runware", "format", format, "bytes", len(data))
+
+	return &GeneratedImage{
+		Data:     data,
+		Format:   format,
+		Provider: runwareProviderName,
+		Model:    request.Model.ID,
+		TaskID:   taskUUID,
+	}, nil
+}
+
+// requestImage runs the imageInference task, it returns the URL of the image
+func (p *RunwareProvider) requestImage(ctx context.Context, taskUUID string, request ImageRequest) (string, error) {
+	// Prepare request payload
+	payload := []map[string]interface{}{
+		request.Model.runwarePayload(taskUUID, request.Prompt.Text),
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.apiURL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", transientError(fmt.Errorf("failed to call Runware API: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", httpStatusError(resp.StatusCode, "runware API error (status %d): %s", resp.StatusCode, string(body))
+	}
+
+	var apiResp struct {
+		Data []struct {
+			ImageURL string `json:"imageURL"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return "", transientError(fmt.Errorf("failed to decode Runware response: %w", err))
+	}
+
+	if len(apiResp.Data) == 0 || apiResp.Data[0].ImageURL == "" {
+		return "", fmt.Errorf("no image URL found in Runware response")
+	}
+
+	return apiResp.Data[0].ImageURL, nil
+}
+
+// download fetches the generated image
+func (p *RunwareProvider) download(ctx context.Context, imageURL string) ([]byte, error) {
+	defer observeStage(stageDownload, time.Now())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download request: %w", err)
+	}
+
+	imgResp, err := p.client.Do(req)
+	if err != nil {
+		return nil, transientError(fmt.Errorf("failed to download image: %w", err))
+	}
+	defer imgResp.Body.Close()
+	if imgResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(imgResp.Body)
+		return nil, httpStatusError(imgResp.StatusCode, "failed to download image, status: %d, body: %s", imgResp.StatusCode, string(body))
+	}
+
+	data, err := io.ReadAll(imgResp.Body)
+	if err != nil {
+		return nil, transientError(fmt.Errorf("failed to download image: %w", err))
+	}
+	return data, nil
+}
@@ -1,56 +1,289 @@
-// this module send the generated image to discord channel
+// this module send the generated image to discord channel, as an embed with the rolled attributes.
+// It posts with the bot token to the channel, or to a webhook, and waits when Discord rate-limits it
 
 package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"genImage/config"
-	"log"
+	"io"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"genImage/config"
 )
 
-// SendImageToDiscord sends the generated image to a Discord channel
-func SendImageToDiscord(imagePath string, username string) {
-	discordSecrets := config.GetDiscordSecrets()
+// DiscordSettings configures the Discord posts
+type DiscordSettings struct {
+	// BaseURL is the Discord API URL, it can point to a local server in tests. The webhooks are posted
+	// to it as well, only the ID and token of the webhook URL are used.
+	BaseURL        string `json:"base_url"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	// MaxAttempts is how many times a post is sent when Discord rate-limits it or fails
+	MaxAttempts int `json:"max_attempts"`
+	// MaxRetryAfterSeconds is the longest rate limit waited for, the post is dropped if Discord asks for more
+	MaxRetryAfterSeconds int `json:"max_retry_after_seconds"`
+}
 
-	if discordSecrets.Token == "" || discordSecrets.ChannelId == "" {
-		log.Printf("discord configuration is missing: token or channel ID not set")
-		return
+// DefaultDiscordSettings returns the settings used when settings.json doesn't define them
+func DefaultDiscordSettings() DiscordSettings {
+	return DiscordSettings{
+		BaseURL:              "https://discord.com/api/v10",
+		TimeoutSeconds:       30,
+		MaxAttempts:          3,
+		MaxRetryAfterSeconds: 60,
+	}
+}
+
+// rarityColors are the embed colors of the rarity tiers, the other tiers get the common one
+var rarityColors = map[string]int{
+	"common":    0x95a5a6,
+	"rare":      0x3498db,
+	"epic":      0x9b59b6,
+	"legendary": 0xf1c40f,
+}
+
+// DiscordPublisher is the sink posting the generated images to Discord. It is shared by the workers,
+// so the rate limit reported by Discord applies to all of them.
+type DiscordPublisher struct {
+	name          string
+	store         ImageStore
+	postURL       string
+	authorization string
+	// webhookToken is the secret part of the webhook URL, it is redacted from the errors
+	webhookToken  string
+	maxAttempts   int
+	maxRetryAfter time.Duration
+	client        *http.Client
+
+	mu sync.Mutex
+	// blockedUntil is when Discord accepts posts again, after a 429 or once the bucket is exhausted
+	blockedUntil time.Time
+}
+
+// NewDiscordPublisher returns a publisher posting with the bot token to the channel,
+// or to the webhook if its URL is set
+func NewDiscordPublisher(name string, settings DiscordSettings, secrets config.DiscordSecrets, store ImageStore) (*DiscordPublisher, error) {
+	defaults := DefaultDiscordSettings()
+	if settings.BaseURL == "" {
+		settings.BaseURL = defaults.BaseURL
+	}
+	if settings.TimeoutSeconds <= 0 {
+		settings.TimeoutSeconds = defaults.TimeoutSeconds
 	}
+	if settings.MaxAttempts <= 0 {
+		settings.MaxAttempts = defaults.MaxAttempts
+	}
+	if settings.MaxRetryAfterSeconds <= 0 {
+		settings.MaxRetryAfterSeconds = defaults.MaxRetryAfterSeconds
+	}
+	baseURL := strings.TrimRight(settings.BaseURL, "/")
 
-	imagePath = fmt.Sprintf("../websiteOverlay/output_images/%s", imagePath)
+	p := &DiscordPublisher{
+		name:          name,
+		store:         store,
+		maxAttempts:   settings.MaxAttempts,
+		maxRetryAfter: time.Duration(settings.MaxRetryAfterSeconds) * time.Second,
+		client:        &http.Client{Timeout: time.Duration(settings.TimeoutSeconds) * time.Second},
+	}
 
-	// Read the image file
-	imageData, err := os.ReadFile(imagePath)
+	if secrets.WebhookURL != "" {
+		// https://discord.com/api/webhooks/<id>/<token>, the token authorizes the post
+		webhookURL, err := url.Parse(secrets.WebhookURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Discord webhook URL: %w", err)
+		}
+		i := strings.Index(webhookURL.Path, "/webhooks/")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid Discord webhook URL: no /webhooks/ path")
+		}
+		// wait=true makes Discord return the errors of the post instead of accepting it blindly
+		query := webhookURL.Query()
+		query.Set("wait", "true")
+		p.postURL = baseURL + webhookURL.Path[i:] + "?" + query.Encode()
+		p.webhookToken = path.Base(webhookURL.Path)
+		return p, nil
+	}
+
+	p.postURL = fmt.Sprintf("%s/channels/%s/messages", baseURL, secrets.ChannelId)
+	p.authorization = fmt.Sprintf("Bot %s", secrets.Token)
+	return p, nil
+}
+
+// newDiscordPublisher returns the publisher, or nil if neither a webhook nor a bot token and channel are configured
+func newDiscordPublisher(name string, settings DiscordSettings, secrets config.DiscordSecrets, store ImageStore) (*DiscordPublisher, error) {
+	if secrets.WebhookURL == "" && (secrets.Token == "" || secrets.ChannelId == "") {
+		slog.Warn("Discord configuration is missing: webhook URL or token and channel ID not set, sink is disabled", "sink", name)
+		return nil, nil
+	}
+	return NewDiscordPublisher(name, settings, secrets, store)
+}
+
+// Name identifies the sink in the logs and the metrics
+func (p *DiscordPublisher) Name() string {
+	return p.name
+}
+
+// Publish posts the image, read from the image store, with an embed describing it.
+// The post is retried when Discord rate-limits it or fails, up to the max attempts.
+func (p *DiscordPublisher) Publish(ctx context.Context, post ImagePost) error {
+	// Read the image from the store
+	imageData, err := p.store.Get(ctx, post.ImagePath)
 	if err != nil {
-		log.Printf("failed to read image file: %v", err)
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+
+	body, contentType, err := discordMessage(post, imageData)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := p.waitForRateLimit(ctx); err != nil {
+			return err
+		}
+
+		retry, err := p.send(ctx, body, contentType)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= p.maxAttempts || ctx.Err() != nil {
+			return err
+		}
+		slog.WarnContext(ctx, "Discord post failed, retrying", "attempt", attempt, "error", err)
+	}
+}
+
+// send posts the message once, retry reports whether the post can succeed if sent again
+func (p *DiscordPublisher) send(ctx context.Context, body []byte, contentType string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.postURL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if p.authorization != "" {
+		req.Header.Set("Authorization", p.authorization)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// The URL of the error holds the token of the webhook
+		return true, fmt.Errorf("failed to send HTTP request: %w", redactToken(err, p.webhookToken))
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	p.updateRateLimit(ctx, resp, respBody)
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		discordRateLimits.Inc()
+		return true, fmt.Errorf("discord API rate-limited the post: %s", string(respBody))
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("discord API returned status %d: %s", resp.StatusCode, string(respBody))
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return false, fmt.Errorf("discord API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return false, nil
+}
+
+// rateLimitResponse is the body of a 429, retry_after is more precise than the Retry-After header
+type rateLimitResponse struct {
+	RetryAfter float64 `json:"retry_after"`
+	Global     bool    `json:"global"`
+}
+
+// updateRateLimit blocks the next posts for as long as Discord asks: after a 429, or when the response
+// says the bucket has no requests left until it resets
+func (p *DiscordPublisher) updateRateLimit(ctx context.Context, resp *http.Response, body []byte) {
+	var wait time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var limited rateLimitResponse
+		if json.Unmarshal(body, &limited) == nil && limited.RetryAfter > 0 {
+			wait = secondsDuration(limited.RetryAfter)
+		} else {
+			wait = headerSeconds(resp.Header, "Retry-After")
+		}
+		slog.WarnContext(ctx, "Discord rate limit hit", "retry_after", wait,
+			"global", limited.Global || resp.Header.Get("X-RateLimit-Global") == "true",
+			"bucket", resp.Header.Get("X-RateLimit-Bucket"))
+	} else if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		wait = headerSeconds(resp.Header, "X-RateLimit-Reset-After")
+		slog.DebugContext(ctx, "Discord rate limit bucket exhausted", "reset_after", wait,
+			"bucket", resp.Header.Get("X-RateLimit-Bucket"))
+	}
+	if wait <= 0 {
 		return
 	}
 
-	// Get just the filename without path
-	baseFilename := filepath.Base(imagePath)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if until := time.Now().Add(wait); until.After(p.blockedUntil) {
+		p.blockedUntil = until
+	}
+}
+
+// waitForRateLimit waits until Discord accepts posts again, it fails if the wait is longer than allowed
+func (p *DiscordPublisher) waitForRateLimit(ctx context.Context) error {
+	p.mu.Lock()
+	wait := time.Until(p.blockedUntil)
+	p.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	if wait > p.maxRetryAfter {
+		return fmt.Errorf("discord API is rate-limited for %s, longer than the %s allowed", wait.Round(time.Second), p.maxRetryAfter)
+	}
+	sleepContext(ctx, wait)
+	return ctx.Err()
+}
+
+// headerSeconds parses a header holding seconds, possibly with a fraction, 0 if it is missing or invalid
+func headerSeconds(header http.Header, name string) time.Duration {
+	seconds, err := strconv.ParseFloat(header.Get(name), 64)
+	if err != nil {
+		return 0
+	}
+	return secondsDuration(seconds)
+}
+
+// secondsDuration converts seconds with a fraction to a duration
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// discordMessage builds the multipart body of the post: the embed and the image attached to it
+func discordMessage(post ImagePost, imageData []byte) ([]byte, string, error) {
+	// The embed refers to the attachment by its filename, which can't hold a path
+	filename := path.Base(post.ImagePath)
 
-	// Create the JSON payload
+	// The description of the attachment is its public alt text, so it can't be the prompt
+	// which holds the private description of the user
 	payload := map[string]interface{}{
-		"content": fmt.Sprintf("Image generated for %s", username),
+		"embeds": []map[string]interface{}{discordEmbed(post, filename)},
 		"attachments": []map[string]interface{}{
 			{
 				"id":          0,
-				"description": "Generated image",
-				"filename":    baseFilename,
+				"description": truncate(post.title(), 1024),
+				"filename":    filename,
 			},
 		},
 	}
 
 	payloadJSON, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("failed to marshal payload: %v", err)
-		return
+		return nil, "", fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
 	// Create a buffer to hold the multipart data
@@ -60,54 +293,86 @@ func SendImageToDiscord(imagePath string, username string) {
 	// Add the JSON payload
 	payloadPart, err := writer.CreateFormField("payload_json")
 	if err != nil {
-		log.Printf("failed to create payload field: %v", err)
-		return
+		return nil, "", fmt.Errorf("failed to create payload field: %w", err)
 	}
 	payloadPart.Write(payloadJSON)
 
 	// Add the image file
-	filePart, err := writer.CreateFormFile("files[0]", baseFilename)
+	filePart, err := writer.CreateFormFile("files[0]", filename)
 	if err != nil {
-		log.Printf("failed to create file field: %v", err)
-		return
+		return nil, "", fmt.Errorf("failed to create file field: %w", err)
 	}
 	filePart.Write(imageData)
 
 	// Close the multipart writer
-	err = writer.Close()
-	if err != nil {
-		log.Printf("failed to close multipart writer: %v", err)
-		return
+	if err := writer.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to close multipart writer: %w", err)
 	}
+	return buf.Bytes(), writer.FormDataContentType(), nil
+}
 
-	// Create the Discord API URL
-	apiURL := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages", discordSecrets.ChannelId)
+// discordEmbed describes the image: who it is for, the event, the rarity, the model and the rolled attributes
+func discordEmbed(post ImagePost, filename string) map[string]interface{} {
+	rarity := post.rarity()
+	color, ok := rarityColors[rarity]
+	if !ok {
+		color = rarityColors["common"]
+	}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", apiURL, &buf)
-	if err != nil {
-		log.Printf("failed to create HTTP request: %v", err)
-		return
+	fields := []map[string]interface{}{
+		embedField("Rarity", rarity, true),
+		embedField("Event", describeEvent(post.Event), true),
+		embedField("Model", fmt.Sprintf("%s/%s", post.Provider, post.Model), true),
+	}
+	attributes := []struct{ name, value string }{
+		{"Background", post.Prompt.Background},
+		{"Emotion", post.Prompt.Emotion},
+		{"Action", post.Prompt.ActionOrSign},
+		{"Modifiers", strings.Join(post.Prompt.EventModifiers, "\n")},
+	}
+	for _, attribute := range attributes {
+		// Discord rejects the fields with an empty value
+		if attribute.value != "" {
+			fields = append(fields, embedField(attribute.name, attribute.value, false))
+		}
 	}
 
-	// Set required headers
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Authorization", fmt.Sprintf("Bot %s", discordSecrets.Token))
+	return map[string]interface{}{
+		"title":     truncate(post.title(), 256),
+		"color":     color,
+		"fields":    fields,
+		"image":     map[string]string{"url": "attachment://" + filename},
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+}
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("failed to send HTTP request: %v", err)
-		return
+// embedField returns an embed field, the value is truncated to the length accepted by Discord
+func embedField(name string, value string, inline bool) map[string]interface{} {
+	return map[string]interface{}{
+		"name":   name,
+		"value":  truncate(value, 1024),
+		"inline": inline,
 	}
-	defer resp.Body.Close()
+}
 
-	// Check response status
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		log.Printf("discord API returned status %d", resp.StatusCode)
-		return
+// describeEvent returns the event type with what makes the event special
+func describeEvent(event Event) string {
+	switch {
+	case event.NBits != nil:
+		return fmt.Sprintf("%s (%d bits)", event.EventType, *event.NBits)
+	case event.Quantity != nil && *event.Quantity > 1:
+		return fmt.Sprintf("%s (%d subs)", event.EventType, *event.Quantity)
+	case event.Months > 1:
+		return fmt.Sprintf("%s (%d months)", event.EventType, event.Months)
 	}
+	return event.EventType
+}
 
-	log.Printf("Successfully sent image to Discord channel")
+// truncate cuts the text to at most max runes, marking the cut with an ellipsis
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-1]) + "…"
 }
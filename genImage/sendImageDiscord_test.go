@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"genImage/config"
+)
+
+// discordResponse is a response of the stub Discord API
+type discordResponse struct {
+	status  int
+	headers map[string]string
+	body    string
+}
+
+// newDiscordStub returns a Discord API answering the posts with the responses in order, the last one repeated
+func newDiscordStub(t *testing.T, responses []discordResponse) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(requests.Add(1)) - 1
+		if i >= len(responses) {
+			i = len(responses) - 1
+		}
+		for name, value := range responses[i].headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(responses[i].status)
+		w.Write([]byte(responses[i].body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// newTestDiscordPublisher returns a publisher posting to the server, with an image to post in its store
+func newTestDiscordPublisher(t *testing.T, server *httptest.Server, settings DiscordSettings) (*DiscordPublisher, ImagePost) {
+	t.Helper()
+	store, err := NewLocalImageStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("NewLocalImageStore() error = %v", err)
+	}
+	post := ImagePost{Username: "alice", ImagePath: "img.png", Event: Event{EventType: "sub"}}
+	if err := store.Put(context.Background(), post.ImagePath, []byte("png"), "image/png"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	settings.BaseURL = server.URL
+	publisher, err := NewDiscordPublisher("discord", settings, config.DiscordSecrets{Token: "token", ChannelId: "channel"}, store)
+	if err != nil {
+		t.Fatalf("NewDiscordPublisher() error = %v", err)
+	}
+	return publisher, post
+}
+
+func TestDiscordPublisherRateLimits(t *testing.T) {
+	rateLimited := discordResponse{status: http.StatusTooManyRequests, body: `{"retry_after": 0.05, "global": false}`}
+	ok := discordResponse{status: http.StatusOK, body: `{}`}
+
+	tests := []struct {
+		name         string
+		responses    []discordResponse
+		settings     DiscordSettings
+		wantErr      bool
+		wantRequests int32
+		// minElapsed is how long the publish must have waited for the rate limit
+		minElapsed time.Duration
+	}{
+		{
+			name:         "429 is retried after retry_after",
+			responses:    []discordResponse{rateLimited, ok},
+			settings:     DiscordSettings{MaxAttempts: 3},
+			wantRequests: 2,
+			minElapsed:   50 * time.Millisecond,
+		},
+		{
+			name: "Retry-After header is used without a body",
+			responses: []discordResponse{
+				{status: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "0.05"}},
+				ok,
+			},
+			settings:     DiscordSettings{MaxAttempts: 3},
+			wantRequests: 2,
+			minElapsed:   50 * time.Millisecond,
+		},
+		{
+			name:         "429 gives up after the max attempts",
+			responses:    []discordResponse{rateLimited},
+			settings:     DiscordSettings{MaxAttempts: 3},
+			wantErr:      true,
+			wantRequests: 3,
+		},
+		{
+			name:         "retry_after longer than allowed is not waited for",
+			responses:    []discordResponse{{status: http.StatusTooManyRequests, body: `{"retry_after": 30}`}, ok},
+			settings:     DiscordSettings{MaxAttempts: 3, MaxRetryAfterSeconds: 1},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+		{
+			name:         "server errors are retried",
+			responses:    []discordResponse{{status: http.StatusBadGateway}, ok},
+			settings:     DiscordSettings{MaxAttempts: 3},
+			wantRequests: 2,
+		},
+		{
+			name:         "client errors are not retried",
+			responses:    []discordResponse{{status: http.StatusBadRequest, body: `{"message": "Invalid Form Body"}`}, ok},
+			settings:     DiscordSettings{MaxAttempts: 3},
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newDiscordStub(t, tt.responses)
+			publisher, post := newTestDiscordPublisher(t, server, tt.settings)
+
+			start := time.Now()
+			err := publisher.Publish(context.Background(), post)
+			elapsed := time.Since(start)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+			if elapsed < tt.minElapsed {
+				t.Errorf("Publish() took %s, want at least %s", elapsed, tt.minElapsed)
+			}
+		})
+	}
+}
+
+func TestDiscordPublisherWaitsForExhaustedBucket(t *testing.T) {
+	server, requests := newDiscordStub(t, []discordResponse{{
+		status:  http.StatusOK,
+		headers: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset-After": "0.05"},
+		body:    `{}`,
+	}})
+	publisher, post := newTestDiscordPublisher(t, server, DiscordSettings{})
+
+	if err := publisher.Publish(context.Background(), post); err != nil {
+		t.Fatalf("first Publish() error = %v", err)
+	}
+	start := time.Now()
+	if err := publisher.Publish(context.Background(), post); err != nil {
+		t.Fatalf("second Publish() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("second Publish() took %s, want it to wait for the bucket reset", elapsed)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+}
+
+func TestDiscordPublisherRedactsWebhookToken(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	store, err := NewLocalImageStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("NewLocalImageStore() error = %v", err)
+	}
+	if err := store.Put(context.Background(), "img.png", []byte("png"), "image/png"); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	secrets := config.DiscordSecrets{WebhookURL: "https://discord.com/api/webhooks/123/secret-token"}
+	publisher, err := NewDiscordPublisher("discord", DiscordSettings{BaseURL: server.URL, MaxAttempts: 1}, secrets, store)
+	if err != nil {
+		t.Fatalf("NewDiscordPublisher() error = %v", err)
+	}
+
+	err = publisher.Publish(context.Background(), ImagePost{Username: "alice", ImagePath: "img.png"})
+	if err == nil {
+		t.Fatal("Publish() to a closed server returned no error")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("Publish() error = %q, it contains the webhook token", err)
+	}
+}
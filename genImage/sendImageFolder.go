@@ -0,0 +1,85 @@
+// this module drops the generated images in a folder, each with a JSON file describing it,
+// for the tools watching the folder. The files are renamed in place once written, so they never
+// show up partially written.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FolderSink is the sink writing the generated images to a drop folder
+type FolderSink struct {
+	name  string
+	dir   string
+	store ImageStore
+}
+
+// NewFolderSink returns a sink writing to dir, which is created if it doesn't exist
+func NewFolderSink(name string, dir string, store ImageStore) (*FolderSink, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("drop folder not set")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create drop folder: %w", err)
+	}
+
+	return &FolderSink{name: name, dir: dir, store: store}, nil
+}
+
+// Name identifies the sink in the logs and the metrics
+func (s *FolderSink) Name() string {
+	return s.name
+}
+
+// Publish writes the image, read from the image store, and its JSON next to it with the same name.
+// The JSON is written last, so a watcher can wait for it to know the image is complete.
+func (s *FolderSink) Publish(ctx context.Context, post ImagePost) error {
+	imageData, err := s.store.Get(ctx, post.ImagePath)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+
+	description, err := json.MarshalIndent(newImagePostJSON(ctx, s.store, post), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image post: %w", err)
+	}
+
+	// The key of the image is its filename
+	filename := path.Base(post.ImagePath)
+	if err := writeFileAtomic(filepath.Join(s.dir, filename), imageData); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+	jsonName := strings.TrimSuffix(filename, path.Ext(filename)) + ".json"
+	if err := writeFileAtomic(filepath.Join(s.dir, jsonName), description); err != nil {
+		return fmt.Errorf("failed to write image description: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file under a temporary name in the same folder, then renames it
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-"+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
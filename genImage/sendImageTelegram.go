@@ -0,0 +1,131 @@
+// this module send the generated image to a telegram chat as a photo, with the rolled attributes as caption.
+// It uses the bot of the alerts, the chat can be a different one
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// telegramCaptionLength is the longest caption accepted by sendPhoto
+const telegramCaptionLength = 1024
+
+// TelegramPhotoSink is the sink sending the generated images to a telegram chat
+type TelegramPhotoSink struct {
+	name     string
+	baseURL  string
+	botToken string
+	chatID   string
+	store    ImageStore
+	client   *http.Client
+}
+
+// NewTelegramPhotoSink returns a sink sending the photos to the chat through the Bot API at the base URL of the settings
+func NewTelegramPhotoSink(name string, settings TelegramSettings, botToken string, chatID string, store ImageStore) *TelegramPhotoSink {
+	if settings.BaseURL == "" {
+		settings.BaseURL = DefaultTelegramSettings().BaseURL
+	}
+
+	return &TelegramPhotoSink{
+		name:     name,
+		baseURL:  strings.TrimRight(settings.BaseURL, "/"),
+		botToken: botToken,
+		chatID:   chatID,
+		store:    store,
+		// the photos are larger than the alerts, so they get more time
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Name identifies the sink in the logs and the metrics
+func (s *TelegramPhotoSink) Name() string {
+	return s.name
+}
+
+// Publish sends the image, read from the image store, as a photo with its caption
+func (s *TelegramPhotoSink) Publish(ctx context.Context, post ImagePost) error {
+	imageData, err := s.store.Get(ctx, post.ImagePath)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if err := writer.WriteField("chat_id", s.chatID); err != nil {
+		return fmt.Errorf("failed to create chat_id field: %w", err)
+	}
+	if err := writer.WriteField("caption", telegramCaption(post)); err != nil {
+		return fmt.Errorf("failed to create caption field: %w", err)
+	}
+	filePart, err := writer.CreateFormFile("photo", path.Base(post.ImagePath))
+	if err != nil {
+		return fmt.Errorf("failed to create photo field: %w", err)
+	}
+	filePart.Write(imageData)
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+
+	apiURL := fmt.Sprintf("%s/bot%s/sendPhoto", s.baseURL, s.botToken)
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, &buf)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// the error holds the URL, and so the bot token
+		return fmt.Errorf("failed to call telegram API: %w", redactToken(err, s.botToken))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		var failure struct {
+			Description string `json:"description"`
+		}
+		if json.Unmarshal(body, &failure) == nil && failure.Description != "" {
+			return fmt.Errorf("telegram API returned status %d: %s", resp.StatusCode, failure.Description)
+		}
+		return fmt.Errorf("telegram API returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// telegramCaption describes the image in the caption: the title, the event, the model and the rolled attributes
+func telegramCaption(post ImagePost) string {
+	lines := []string{
+		post.title(),
+		fmt.Sprintf("Event: %s", describeEvent(post.Event)),
+		fmt.Sprintf("Model: %s/%s", post.Provider, post.Model),
+	}
+	attributes := []struct{ name, value string }{
+		{"Background", post.Prompt.Background},
+		{"Emotion", post.Prompt.Emotion},
+		{"Action", post.Prompt.ActionOrSign},
+	}
+	for _, attribute := range attributes {
+		if attribute.value != "" {
+			lines = append(lines, fmt.Sprintf("%s: %s", attribute.name, attribute.value))
+		}
+	}
+	return truncate(strings.Join(lines, "\n"), telegramCaptionLength)
+}
+
+// redactToken replaces the token in the error message, so it doesn't end up in the logs
+func redactToken(err error, token string) error {
+	if token == "" || !strings.Contains(err.Error(), token) {
+		return err
+	}
+	return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), token, "<token>"))
+}
@@ -0,0 +1,96 @@
+// this module posts the description of the generated image as JSON to a webhook, signed so the receiver
+// can check it comes from genImage. The signature is the hex HMAC-SHA256, keyed by the signing secret,
+// of the timestamp header, a dot and the body.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// webhookTimestampHeader holds the Unix time of the post, the receiver can reject the old ones
+	webhookTimestampHeader = "X-SubVision-Timestamp"
+	// webhookSignatureHeader holds sha256= and the signature of the post
+	webhookSignatureHeader = "X-SubVision-Signature"
+)
+
+// WebhookSink is the sink posting the signed JSON description of the generated images
+type WebhookSink struct {
+	name   string
+	url    string
+	secret []byte
+	store  ImageStore
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink posting to the URL, the posts are signed with the secret
+func NewWebhookSink(name string, url string, secret string, store ImageStore) (*WebhookSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("webhook URL not set")
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("webhook signing secret not set")
+	}
+
+	return &WebhookSink{
+		name:   name,
+		url:    url,
+		secret: []byte(secret),
+		store:  store,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Name identifies the sink in the logs and the metrics
+func (s *WebhookSink) Name() string {
+	return s.name
+}
+
+// Publish posts the description of the image, with the URLs of the image and its thumbnail
+func (s *WebhookSink) Publish(ctx context.Context, post ImagePost) error {
+	body, err := json.Marshal(newImagePostJSON(ctx, s.store, post))
+	if err != nil {
+		return fmt.Errorf("failed to marshal image post: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(s.secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of the timestamp, a dot and the body
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
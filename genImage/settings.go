@@ -0,0 +1,58 @@
+// this module loads the tunable settings of the service from settings.json
+// every section falls back to its defaults when it is missing from the file
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+
+	"subvisionCore/typedconfig"
+)
+
+// Settings represents the structure of the settings JSON file
+type Settings struct {
+	Retry    RetryPolicy      `json:"retry"`
+	Telegram TelegramSettings `json:"telegram"`
+	Storage  StorageSettings  `json:"storage"`
+	// Catalog is where the metadata of the images is saved, it must not be publicly readable
+	Catalog StorageSettings `json:"catalog"`
+	// PostProcess is the post-processing of the generated images
+	PostProcess PostProcessSettings `json:"post_processing"`
+	// Quota limits the images generated for every user
+	Quota QuotaSettings `json:"quota"`
+	// GiftBomb is how the submysterygift events are rendered
+	GiftBomb GiftBombSettings `json:"gift_bomb"`
+	// Discord is where the generated images are posted
+	Discord DiscordSettings `json:"discord"`
+	// Sinks are where the generated images are published, with their filters
+	Sinks []SinkSettings `json:"sinks"`
+}
+
+// DefaultSettings returns the settings used when settings.json is missing
+func DefaultSettings() *Settings {
+	return &Settings{
+		Retry:    DefaultRetryPolicy(),
+		Telegram: DefaultTelegramSettings(),
+		Storage:  DefaultStorageSettings(),
+		Catalog:  DefaultCatalogSettings(),
+
+		PostProcess: DefaultPostProcessSettings(),
+		Quota:       DefaultQuotaSettings(),
+		GiftBomb:    DefaultGiftBombSettings(),
+		Discord:     DefaultDiscordSettings(),
+		Sinks:       DefaultSinkSettings(),
+	}
+}
+
+// loadSettings loads the settings from the given JSON file on top of the defaults
+func loadSettings(path string) (*Settings, error) {
+	settings, err := typedconfig.Load(path, *DefaultSettings())
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("Settings file not found, using default settings", "path", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
@@ -0,0 +1,260 @@
+// this module publishes the generated images to the configured sinks, besides the overlay.
+// Every sink has its own filter, and they are published to in parallel so a failing or slow sink
+// doesn't affect the others
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"genImage/config"
+)
+
+// sink types, set in the type of the sink settings
+const (
+	sinkDiscord  = "discord"
+	sinkTelegram = "telegram"
+	sinkWebhook  = "webhook"
+	sinkFolder   = "folder"
+)
+
+// ImagePost is what the sinks publish about a generated image
+type ImagePost struct {
+	UserID        int
+	Username      string
+	ImagePath     string
+	ThumbnailPath string
+	Event         Event
+	Prompt        GeneratedPrompt
+	Provider      string
+	Model         string
+}
+
+// newImagePost returns the post of an image just generated for the event
+func newImagePost(payload MessagePayload, prompt GeneratedPrompt, result *GenerationResult) ImagePost {
+	return ImagePost{
+		UserID:        payload.UserID,
+		Username:      payload.Username,
+		ImagePath:     result.ImagePath,
+		ThumbnailPath: result.ThumbnailPath,
+		Event:         payload.Event,
+		Prompt:        prompt,
+		Provider:      result.Generated.Provider,
+		Model:         result.Generated.Model,
+	}
+}
+
+// rarity returns the rarity rolled for the image, common if none was
+func (p ImagePost) rarity() string {
+	if p.Prompt.Rarity == "" {
+		return "common"
+	}
+	return p.Prompt.Rarity
+}
+
+// title returns the headline of the post, shouting the rarity of the uncommon pulls
+func (p ImagePost) title() string {
+	title := fmt.Sprintf("Image generated for %s", p.Username)
+	if rarity := p.rarity(); rarity != "common" {
+		title = fmt.Sprintf("%s - %s pull!", title, strings.ToUpper(rarity))
+	}
+	return title
+}
+
+// Sink publishes the generated images somewhere
+type Sink interface {
+	// Name identifies the sink in the logs and the metrics
+	Name() string
+	// Publish publishes the image, it is only called for the images matching the filter of the sink
+	Publish(ctx context.Context, post ImagePost) error
+}
+
+// SinkFilter selects the images published by a sink, an empty list matches everything
+type SinkFilter struct {
+	// Rarities are the rolled rarities, like legendary to only publish the golden pulls
+	Rarities []string `json:"rarities"`
+	// EventTypes are the event types, like bits or submysterygift
+	EventTypes []string `json:"event_types"`
+	// UserTiers are the subscription tiers, like Tier3 or Prime
+	UserTiers []string `json:"user_tiers"`
+}
+
+// Matches reports whether the image passes every list of the filter
+func (f SinkFilter) Matches(post ImagePost) bool {
+	return matchesAny(f.Rarities, post.rarity()) &&
+		matchesAny(f.EventTypes, post.Event.EventType) &&
+		matchesAny(f.UserTiers, post.Event.UserTier)
+}
+
+// matchesAny reports whether the value is in the list, or the list is empty
+func matchesAny(list []string, value string) bool {
+	return len(list) == 0 || slices.Contains(list, value)
+}
+
+// SinkSettings configures a sink, the fields besides type, name and filter depend on the type
+type SinkSettings struct {
+	// Type is discord, telegram, webhook or folder
+	Type string `json:"type"`
+	// Name identifies the sink, it defaults to the type and must be unique
+	Name   string     `json:"name"`
+	Filter SinkFilter `json:"filter"`
+	// ChatID is the telegram chat the photos are sent to, the chat of the alerts if empty
+	ChatID string `json:"chat_id"`
+	// URL is where the webhook posts the signed JSON
+	URL string `json:"url"`
+	// Dir is the drop folder the images and their JSON are written to
+	Dir string `json:"dir"`
+}
+
+// DefaultSinkSettings returns the sinks used when settings.json doesn't define them, the Discord channel only
+func DefaultSinkSettings() []SinkSettings {
+	return []SinkSettings{{Type: sinkDiscord}}
+}
+
+// filteredSink is a sink with the filter selecting its images
+type filteredSink struct {
+	sink   Sink
+	filter SinkFilter
+}
+
+// Sinks are the sinks the generated images are published to
+type Sinks []filteredSink
+
+// newSinks creates the configured sinks, the Discord and Telegram sinks without credentials are left out
+func newSinks(sinks []SinkSettings, discord DiscordSettings, telegram TelegramSettings, store ImageStore) (Sinks, error) {
+	var created Sinks
+	names := make(map[string]bool)
+	for _, settings := range sinks {
+		name := settings.Name
+		if name == "" {
+			name = settings.Type
+		}
+		if names[name] {
+			return nil, fmt.Errorf("sink %q is configured twice, set a different name to each", name)
+		}
+		names[name] = true
+
+		sink, err := newSink(name, settings, discord, telegram, store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sink %q: %w", name, err)
+		}
+		if sink == nil {
+			continue
+		}
+		created = append(created, filteredSink{sink: sink, filter: settings.Filter})
+	}
+	return created, nil
+}
+
+// newSink creates a sink of the type of the settings, nil if its credentials are not configured
+func newSink(name string, settings SinkSettings, discord DiscordSettings, telegram TelegramSettings, store ImageStore) (Sink, error) {
+	switch settings.Type {
+	case sinkDiscord:
+		publisher, err := newDiscordPublisher(name, discord, config.GetDiscordSecrets(), store)
+		if publisher == nil || err != nil {
+			return nil, err
+		}
+		return publisher, nil
+	case sinkTelegram:
+		secrets := config.GetTelegramSecrets()
+		chatID := settings.ChatID
+		if chatID == "" {
+			chatID = secrets.ChatID
+		}
+		if secrets.BotToken == "" || chatID == "" {
+			slog.Warn("Telegram configuration is missing: bot token or chat ID not set, sink is disabled", "sink", name)
+			return nil, nil
+		}
+		return NewTelegramPhotoSink(name, telegram, secrets.BotToken, chatID, store), nil
+	case sinkWebhook:
+		return NewWebhookSink(name, settings.URL, config.GetWebhookSecrets().SigningSecret, store)
+	case sinkFolder:
+		return NewFolderSink(name, settings.Dir, store)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", settings.Type)
+	}
+}
+
+// Publish publishes the image to every sink whose filter matches it and waits for them.
+// The failures are logged per sink, a sink failing or panicking doesn't stop the others.
+func (s Sinks) Publish(ctx context.Context, post ImagePost) {
+	var wg sync.WaitGroup
+	for _, filtered := range s {
+		if !filtered.filter.Matches(post) {
+			sinkPublications.WithLabelValues(filtered.sink.Name(), "filtered").Inc()
+			continue
+		}
+
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			sinkCtx := withLogAttrs(ctx, "sink", sink.Name())
+			defer func() {
+				if r := recover(); r != nil {
+					sinkPublications.WithLabelValues(sink.Name(), "failure").Inc()
+					slog.ErrorContext(sinkCtx, "Sink panicked while publishing the image", "panic", r)
+				}
+			}()
+
+			if err := sink.Publish(sinkCtx, post); err != nil {
+				sinkPublications.WithLabelValues(sink.Name(), "failure").Inc()
+				slog.ErrorContext(sinkCtx, "Failed to publish image", "error", err)
+				return
+			}
+			sinkPublications.WithLabelValues(sink.Name(), "success").Inc()
+			slog.InfoContext(sinkCtx, "Image published")
+		}(filtered.sink)
+	}
+	wg.Wait()
+}
+
+// imagePostJSON is the description of an image posted by the webhook and written next to the image in the drop folder.
+// It only has the rolled attributes, the prompt holds the private description of the user.
+type imagePostJSON struct {
+	UserID       int    `json:"user_id"`
+	Username     string `json:"username"`
+	Event        Event  `json:"event"`
+	Rarity       string `json:"rarity"`
+	ImagePath    string `json:"image_path"`
+	ImageURL     string `json:"image_url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Provider     string `json:"provider"`
+	Model        string `json:"model"`
+	Background   string `json:"background,omitempty"`
+	Emotion      string `json:"emotion,omitempty"`
+	ActionOrSign string `json:"action_or_sign,omitempty"`
+}
+
+// newImagePostJSON describes the image, the URLs are resolved from the store now as presigned URLs expire
+func newImagePostJSON(ctx context.Context, store ImageStore, post ImagePost) imagePostJSON {
+	described := imagePostJSON{
+		UserID:       post.UserID,
+		Username:     post.Username,
+		Event:        post.Event,
+		Rarity:       post.rarity(),
+		ImagePath:    post.ImagePath,
+		Provider:     post.Provider,
+		Model:        post.Model,
+		Background:   post.Prompt.Background,
+		Emotion:      post.Prompt.Emotion,
+		ActionOrSign: post.Prompt.ActionOrSign,
+	}
+
+	var err error
+	described.ImageURL, err = store.URL(post.ImagePath)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to get the URL of the image", "image_path", post.ImagePath, "error", err)
+	}
+	if post.ThumbnailPath != "" {
+		described.ThumbnailURL, err = store.URL(post.ThumbnailPath)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to get the URL of the thumbnail", "thumbnail_path", post.ThumbnailPath, "error", err)
+		}
+	}
+	return described
+}
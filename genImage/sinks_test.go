@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestSinkFilterMatches(t *testing.T) {
+	legendaryTier3 := ImagePost{
+		Event:  Event{EventType: "resub", UserTier: "Tier3"},
+		Prompt: GeneratedPrompt{Rarity: "legendary"},
+	}
+	commonCheer := ImagePost{
+		Event: Event{EventType: "bits"},
+	}
+
+	tests := []struct {
+		name   string
+		filter SinkFilter
+		post   ImagePost
+		want   bool
+	}{
+		{name: "empty filter matches everything", filter: SinkFilter{}, post: commonCheer, want: true},
+		{name: "rarity in the list", filter: SinkFilter{Rarities: []string{"epic", "legendary"}}, post: legendaryTier3, want: true},
+		{name: "rarity not in the list", filter: SinkFilter{Rarities: []string{"legendary"}}, post: commonCheer, want: false},
+		{name: "no rarity rolled is common", filter: SinkFilter{Rarities: []string{"common"}}, post: commonCheer, want: true},
+		{name: "event type in the list", filter: SinkFilter{EventTypes: []string{"bits"}}, post: commonCheer, want: true},
+		{name: "event type not in the list", filter: SinkFilter{EventTypes: []string{"bits"}}, post: legendaryTier3, want: false},
+		{name: "user tier in the list", filter: SinkFilter{UserTiers: []string{"Tier3"}}, post: legendaryTier3, want: true},
+		{name: "missing user tier", filter: SinkFilter{UserTiers: []string{"Tier3"}}, post: commonCheer, want: false},
+		{
+			name:   "every list must match",
+			filter: SinkFilter{Rarities: []string{"legendary"}, EventTypes: []string{"bits"}},
+			post:   legendaryTier3,
+			want:   false,
+		},
+		{
+			name:   "values are case sensitive",
+			filter: SinkFilter{Rarities: []string{"Legendary"}},
+			post:   legendaryTier3,
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Matches(tt.post); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,83 +4,54 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
+	"time"
 
 	"genImage/config"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"subvisionCore/description"
 )
 
-// UserDescriptionItem represents the structure of the DynamoDB item
-type UserDescriptionItem struct {
-	UserID      string `json:"userId" dynamodbav:"userId"`
-	Description string `json:"description" dynamodbav:"description"`
-}
-
-// GetUserDescription retrieves a user's description from DynamoDB based on their user ID
-func GetUserDescription(userID int) (string, error) {
-	log.Printf("Getting description for user ID: %d", userID)
-
-	// Get AWS configuration
-	awsSecrets := config.GetAWSSecrets()
-
-	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(awsSecrets.Region),
-		Credentials: credentials.NewStaticCredentials(
-			awsSecrets.AccessKeyID,
-			awsSecrets.SecretAccessKey,
-			"",
-		),
-	})
+// newDescriptionRepository creates the DynamoDB repository of the descriptions, reads are cached for ttl.
+// The descriptions are written by websiteUserDescription, which can't invalidate this cache, so an update
+// is seen after at most ttl. A zero ttl disables the cache: a read per message is cheap next to a generation.
+func newDescriptionRepository(awsSecrets config.AWSSecrets, ttl time.Duration) (description.Repository, error) {
+	sess, err := newAWSSession(awsSecrets)
 	if err != nil {
-		log.Printf("Error creating AWS session: %v", err)
-		return "", fmt.Errorf("failed to create AWS session: %w", err)
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
 	}
 
-	// Create DynamoDB client
-	svc := dynamodb.New(sess)
+	var repository description.Repository = description.NewDynamoRepository(sess)
+	if ttl > 0 {
+		repository = description.NewCachedRepository(repository, ttl)
+	}
+	return repository, nil
+}
 
-	// Convert userID to string for DynamoDB key
-	userIDStr := strconv.Itoa(userID)
+// GetUserDescription retrieves a user's description from the repository based on their user ID
+func GetUserDescription(ctx context.Context, descriptions description.Repository, userID int) (string, error) {
+	slog.InfoContext(ctx, "Getting user description")
 
-	// Prepare the GetItem input
-	input := &dynamodb.GetItemInput{
-		TableName: aws.String("UserDescription"),
-		Key: map[string]*dynamodb.AttributeValue{
-			"userId": {
-				S: aws.String(userIDStr),
-			},
-		},
+	record, err := descriptions.Get(ctx, strconv.Itoa(userID))
+	if errors.Is(err, description.ErrInvalidRecord) {
+		slog.ErrorContext(ctx, "Error reading the user description", "error", err)
+		return "", permanentError(err)
 	}
-
-	// Execute the GetItem operation
-	result, err := svc.GetItem(input)
 	if err != nil {
-		log.Printf("Error getting item from DynamoDB: %v", err)
-		return "", fmt.Errorf("failed to get item from DynamoDB: %w", err)
+		slog.ErrorContext(ctx, "Error getting the user description", "error", err)
+		return "", classifyAWSError(err)
 	}
 
 	// Check if item was found
-	if result.Item == nil {
-		log.Printf("No description found for user ID: %d", userID)
+	if record == nil {
+		slog.InfoContext(ctx, "No description found for user")
 		return "", nil
 	}
 
-	// Unmarshal the result into our struct
-	var item UserDescriptionItem
-	err = dynamodbattribute.UnmarshalMap(result.Item, &item)
-	if err != nil {
-		log.Printf("Error unmarshaling DynamoDB item: %v", err)
-		return "", fmt.Errorf("failed to unmarshal DynamoDB item: %w", err)
-	}
-
-	log.Printf("Successfully retrieved description for user ID: %d", userID)
-	return item.Description, nil
+	slog.InfoContext(ctx, "Successfully retrieved user description")
+	return record.Description, nil
 }
@@ -0,0 +1,20 @@
+//go:build cgo
+
+// this module encodes the WebP images with libwebp, which needs cgo. The builds without cgo
+// (static and cross builds) get webpEncodeDisabled.go instead, and can only use jpeg or png.
+
+package main
+
+import (
+	"image"
+
+	"github.com/chai2010/webp"
+)
+
+// webpEncodingAvailable reports whether the images can be encoded to WebP in this build
+const webpEncodingAvailable = true
+
+// encodeWebP encodes the image to WebP with the quality, from 1 to 100
+func encodeWebP(img image.Image, quality int) ([]byte, error) {
+	return webp.EncodeRGB(img, float32(quality))
+}
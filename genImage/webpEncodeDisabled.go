@@ -0,0 +1,18 @@
+//go:build !cgo
+
+// this module stands in for the WebP encoder in the builds without cgo, libwebp can't be linked there
+
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// webpEncodingAvailable reports whether the images can be encoded to WebP in this build
+const webpEncodingAvailable = false
+
+// encodeWebP fails, the post-processor refuses the webp format before it is called
+func encodeWebP(img image.Image, quality int) ([]byte, error) {
+	return nil, fmt.Errorf("webp encoding needs a build with cgo")
+}
@@ -0,0 +1,212 @@
+// this module runs the message processing on a bounded pool of workers
+// and keeps the in-flight messages hidden from other consumers while they are processed
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxReceiveBatch is the maximum number of messages SQS returns in a single receive
+const maxReceiveBatch = 10
+
+// WorkerPoolConfig configures the concurrency of the message processing
+type WorkerPoolConfig struct {
+	// Workers is the number of messages processed in parallel
+	Workers int
+	// HeartbeatInterval is how often the visibility of in-flight messages is extended
+	HeartbeatInterval time.Duration
+	// VisibilityTimeout is the visibility set on every heartbeat
+	VisibilityTimeout time.Duration
+	// DrainTimeout is how long the in-flight messages can still run on shutdown
+	DrainTimeout time.Duration
+}
+
+// DefaultWorkerPoolConfig returns the default worker pool configuration
+func DefaultWorkerPoolConfig() WorkerPoolConfig {
+	return WorkerPoolConfig{
+		Workers:           4,
+		HeartbeatInterval: defaultVisibilityTimeout / 3,
+		VisibilityTimeout: defaultVisibilityTimeout,
+		DrainTimeout:      45 * time.Second,
+	}
+}
+
+// WorkerPool processes messages concurrently with a bounded number of workers
+type WorkerPool struct {
+	config WorkerPoolConfig
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	// jobs is the context of the handlers, it is canceled when the drain times out
+	jobs       context.Context
+	cancelJobs context.CancelFunc
+
+	mu       sync.Mutex
+	inFlight map[*Message]MessageSource
+	// running is the number of handlers that didn't return, released or not
+	running int
+}
+
+// NewWorkerPool returns a worker pool, invalid values fall back to the defaults
+func NewWorkerPool(config WorkerPoolConfig) *WorkerPool {
+	defaults := DefaultWorkerPoolConfig()
+	if config.Workers <= 0 {
+		config.Workers = defaults.Workers
+	}
+	if config.VisibilityTimeout <= 0 {
+		config.VisibilityTimeout = defaults.VisibilityTimeout
+	}
+	if config.HeartbeatInterval <= 0 || config.HeartbeatInterval >= config.VisibilityTimeout {
+		config.HeartbeatInterval = config.VisibilityTimeout / 3
+	}
+	if config.DrainTimeout < 0 {
+		config.DrainTimeout = 0
+	}
+
+	jobs, cancelJobs := context.WithCancel(context.Background())
+	return &WorkerPool{
+		config:     config,
+		slots:      make(chan struct{}, config.Workers),
+		jobs:       jobs,
+		cancelJobs: cancelJobs,
+		inFlight:   make(map[*Message]MessageSource),
+	}
+}
+
+// WaitForSlot blocks until at least one worker is free and returns the number of free workers,
+// capped to the maximum receive batch size. It returns 0 if ctx is done first.
+func (p *WorkerPool) WaitForSlot(ctx context.Context) int {
+	// acquiring and releasing a slot blocks until a worker is free,
+	// only the receive loop submits so the slot can't be taken in between
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0
+	}
+	<-p.slots
+
+	free := cap(p.slots) - len(p.slots)
+
+	if free > maxReceiveBatch {
+		free = maxReceiveBatch
+	}
+	return free
+}
+
+// Submit runs handle for the message on a free worker, blocking until one is available.
+// The message visibility is extended periodically until handle calls release or returns.
+// Once released the message is done with: the worker is free for the next one and a drain
+// doesn't release the message again, but Wait and Drain still wait for handle to return.
+// The context given to handle is canceled if the message is abandoned on shutdown.
+func (p *WorkerPool) Submit(source MessageSource, message *Message, handle func(ctx context.Context, message *Message, release func())) {
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+
+	p.mu.Lock()
+	p.inFlight[message] = source
+	p.running++
+	p.mu.Unlock()
+
+	go func() {
+		defer p.wg.Done()
+		defer func() {
+			p.mu.Lock()
+			p.running--
+			p.mu.Unlock()
+		}()
+
+		stop := p.startHeartbeat(source, message)
+		var once sync.Once
+		release := func() {
+			once.Do(func() {
+				stop()
+
+				p.mu.Lock()
+				delete(p.inFlight, message)
+				p.mu.Unlock()
+
+				<-p.slots
+			})
+		}
+		defer release()
+
+		handle(p.jobs, message, release)
+	}()
+}
+
+// Wait blocks until all the submitted messages are processed
+func (p *WorkerPool) Wait() {
+	p.wg.Wait()
+}
+
+// Drain waits up to the drain timeout for the handlers to return. The handlers still running after it have
+// their context canceled, and the messages they didn't release are abandoned: they are released to be
+// delivered again right away. It returns the number of handlers that returned in time, the number of
+// canceled handlers whose message was already released, and the abandoned messages.
+func (p *WorkerPool) Drain() (drained int, canceled int, abandoned []*Message) {
+	p.mu.Lock()
+	running := p.running
+	p.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return running, 0, nil
+	case <-time.After(p.config.DrainTimeout):
+	}
+
+	p.cancelJobs()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for message, source := range p.inFlight {
+		// the jobs context is canceled, the release must still reach the queue
+		if err := source.Nack(context.Background(), message); err != nil {
+			slog.ErrorContext(withJob(context.Background(), originalMessageID(message)), "Error releasing abandoned message", "error", err)
+		}
+		abandoned = append(abandoned, message)
+	}
+	return running - p.running, p.running - len(abandoned), abandoned
+}
+
+// startHeartbeat extends the visibility of the message until the returned function is called
+func (p *WorkerPool) startHeartbeat(source MessageSource, message *Message) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(p.config.HeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-p.jobs.Done():
+				// the message was abandoned and released, extending it would hide it again
+				return
+			case <-ticker.C:
+				err := source.ExtendVisibility(p.jobs, message, p.config.VisibilityTimeout)
+				if err != nil {
+					slog.ErrorContext(withJob(context.Background(), originalMessageID(message)), "Error extending visibility of message", "error", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
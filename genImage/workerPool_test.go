@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPool returns a pool and the messages received from a queue holding the bodies
+func newTestPool(t *testing.T, config WorkerPoolConfig, published ...string) (*WorkerPool, *MemoryQueue, []*Message) {
+	t.Helper()
+	q := NewMemoryQueue()
+	q.SetWaitTime(0)
+	for _, body := range published {
+		if err := q.Publish(OutgoingMessage{Body: body}); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	return NewWorkerPool(config), q, receive(t, q, len(published))
+}
+
+func TestWorkerPoolSlots(t *testing.T) {
+	pool, q, messages := newTestPool(t, WorkerPoolConfig{Workers: 2}, "a", "b", "c")
+
+	proceed := make(chan struct{})
+	released := make(chan struct{})
+	finish := make(chan struct{})
+	handle := func(ctx context.Context, message *Message, release func()) {
+		<-proceed
+		// releasing twice must not free a second worker
+		release()
+		release()
+		released <- struct{}{}
+		<-finish
+	}
+	pool.Submit(q, messages[0], handle)
+	pool.Submit(q, messages[1], handle)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if got := pool.WaitForSlot(ctx); got != 0 {
+		t.Errorf("WaitForSlot() with every worker busy = %d, want 0", got)
+	}
+
+	close(proceed)
+	<-released
+	<-released
+	if got := pool.WaitForSlot(context.Background()); got != 2 {
+		t.Errorf("WaitForSlot() after the releases = %d, want 2", got)
+	}
+
+	// the released handlers are still running but don't hold a worker
+	pool.Submit(q, messages[2], func(ctx context.Context, message *Message, release func()) {})
+	if got := pool.WaitForSlot(context.Background()); got != 1 && got != 2 {
+		t.Errorf("WaitForSlot() = %d, want 1 or 2", got)
+	}
+
+	close(finish)
+	pool.Wait()
+	if got := pool.WaitForSlot(context.Background()); got != 2 {
+		t.Errorf("WaitForSlot() after Wait() = %d, want 2", got)
+	}
+}
+
+func TestWorkerPoolDrain(t *testing.T) {
+	tests := []struct {
+		name         string
+		drainTimeout time.Duration
+		handle       func(ctx context.Context, q *MemoryQueue, message *Message, release func())
+		wantDrained  int
+		wantCanceled int
+		// wantAbandoned is whether the message is abandoned and visible again
+		wantAbandoned bool
+	}{
+		{
+			name:         "handlers finishing in time are drained",
+			drainTimeout: time.Second,
+			handle: func(ctx context.Context, q *MemoryQueue, message *Message, release func()) {
+				time.Sleep(10 * time.Millisecond)
+				q.Ack(context.Background(), message)
+				release()
+			},
+			wantDrained: 1,
+		},
+		{
+			name:         "released handlers still running are canceled",
+			drainTimeout: 20 * time.Millisecond,
+			handle: func(ctx context.Context, q *MemoryQueue, message *Message, release func()) {
+				q.Ack(context.Background(), message)
+				release()
+				<-ctx.Done()
+			},
+			wantCanceled: 1,
+		},
+		{
+			name:         "unreleased handlers are abandoned",
+			drainTimeout: 20 * time.Millisecond,
+			handle: func(ctx context.Context, q *MemoryQueue, message *Message, release func()) {
+				<-ctx.Done()
+			},
+			wantAbandoned: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, q, messages := newTestPool(t, WorkerPoolConfig{Workers: 2, DrainTimeout: tt.drainTimeout}, "a")
+			pool.Submit(q, messages[0], func(ctx context.Context, message *Message, release func()) {
+				tt.handle(ctx, q, message, release)
+			})
+
+			drained, canceled, abandoned := pool.Drain()
+			pool.Wait()
+
+			if drained != tt.wantDrained || canceled != tt.wantCanceled {
+				t.Errorf("Drain() drained = %d, canceled = %d, want %d and %d", drained, canceled, tt.wantDrained, tt.wantCanceled)
+			}
+			if got := len(abandoned) == 1; got != tt.wantAbandoned {
+				t.Errorf("Drain() abandoned = %v, want abandoned %v", bodies(abandoned), tt.wantAbandoned)
+			}
+			var wantVisible []string
+			if tt.wantAbandoned {
+				wantVisible = []string{"a"}
+			}
+			if got := bodies(receive(t, q, 1)); !slices.Equal(got, wantVisible) {
+				t.Errorf("Receive() after Drain() = %v, want %v", got, wantVisible)
+			}
+		})
+	}
+}
+
+// extensionCounter counts the visibility extensions of the messages of a memory queue
+type extensionCounter struct {
+	*MemoryQueue
+	mu       sync.Mutex
+	timeouts []time.Duration
+}
+
+func (c *extensionCounter) ExtendVisibility(ctx context.Context, message *Message, timeout time.Duration) error {
+	c.mu.Lock()
+	c.timeouts = append(c.timeouts, timeout)
+	c.mu.Unlock()
+	return c.MemoryQueue.ExtendVisibility(ctx, message, timeout)
+}
+
+func (c *extensionCounter) extensions() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.timeouts)
+}
+
+func TestWorkerPoolHeartbeat(t *testing.T) {
+	config := WorkerPoolConfig{Workers: 1, HeartbeatInterval: 10 * time.Millisecond, VisibilityTimeout: time.Second, DrainTimeout: 60 * time.Millisecond}
+
+	tests := []struct {
+		name string
+		// handle runs for at least 60ms, the heartbeat must be stopped once it releases the message or returns
+		handle func(ctx context.Context, q *MemoryQueue, message *Message, release func())
+		// stop is when the heartbeat must be stopped: on "release", "return", or "drain" which abandons the message
+		stop string
+	}{
+		{
+			name: "stops on release",
+			handle: func(ctx context.Context, q *MemoryQueue, message *Message, release func()) {
+				time.Sleep(60 * time.Millisecond)
+				q.Ack(ctx, message)
+				release()
+				// publishing to the sinks after the release must not extend the deleted message
+				time.Sleep(50 * time.Millisecond)
+			},
+			stop: "release",
+		},
+		{
+			name: "stops when the handler returns",
+			handle: func(ctx context.Context, q *MemoryQueue, message *Message, release func()) {
+				time.Sleep(60 * time.Millisecond)
+			},
+			stop: "return",
+		},
+		{
+			name: "stops when the message is abandoned",
+			handle: func(ctx context.Context, q *MemoryQueue, message *Message, release func()) {
+				<-ctx.Done()
+				time.Sleep(50 * time.Millisecond)
+			},
+			stop: "drain",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, q, messages := newTestPool(t, config, "a")
+			source := &extensionCounter{MemoryQueue: q}
+			released := make(chan struct{})
+			pool.Submit(source, messages[0], func(ctx context.Context, message *Message, release func()) {
+				tt.handle(ctx, q, message, func() {
+					release()
+					close(released)
+				})
+			})
+
+			// release and return wait for the heartbeat to stop, a drain only cancels it
+			// so a tick racing with the cancellation can still extend the message
+			allowed := 0
+			switch tt.stop {
+			case "release":
+				<-released
+			case "return":
+				pool.Wait()
+			case "drain":
+				pool.Drain()
+				allowed = 1
+			}
+			stopped := len(source.extensions())
+			pool.Wait()
+			time.Sleep(3 * config.HeartbeatInterval)
+
+			extensions := source.extensions()
+			if stopped < 3 {
+				t.Errorf("visibility extended %d times while the message was processed, want one per heartbeat", stopped)
+			}
+			for _, timeout := range extensions {
+				if timeout != config.VisibilityTimeout {
+					t.Errorf("ExtendVisibility() timeout = %s, want %s", timeout, config.VisibilityTimeout)
+				}
+			}
+			if len(extensions) > stopped+allowed {
+				t.Errorf("visibility extended %d times after the heartbeat stopped", len(extensions)-stopped)
+			}
+		})
+	}
+}
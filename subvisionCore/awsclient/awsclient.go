@@ -0,0 +1,23 @@
+// Package awsclient creates the AWS sessions of the services from their configured credentials
+package awsclient
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Credentials are the static AWS credentials every service is configured with
+type Credentials struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// NewSession creates an AWS session from the credentials
+func NewSession(creds Credentials) (*session.Session, error) {
+	return session.NewSession(&aws.Config{
+		Region:      aws.String(creds.Region),
+		Credentials: credentials.NewStaticCredentials(creds.AccessKeyID, creds.SecretAccessKey, ""),
+	})
+}
@@ -0,0 +1,17 @@
+// Package description defines the user description record, written by websiteUserDescription
+// and read by genImage to build the prompts.
+package description
+
+const (
+	// TableName is the DynamoDB table of the descriptions, keyed by userId
+	TableName = "UserDescription"
+	// TimeLayout is the layout of LastUpdated
+	TimeLayout = "2006-01-02 15:04:05"
+)
+
+// Record represents the structure of the DynamoDB item
+type Record struct {
+	UserID      string `json:"userId" dynamodbav:"userId"`
+	Description string `json:"description" dynamodbav:"description"`
+	LastUpdated string `json:"lastUpdated" dynamodbav:"lastUpdated"`
+}
@@ -0,0 +1,201 @@
+package description
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// ErrInvalidRecord is returned when a stored item can't be read as a Record, reading it again won't help
+var ErrInvalidRecord = errors.New("invalid description record")
+
+// Repository reads and writes the descriptions. It is created once per process and shared by the requests.
+type Repository interface {
+	// Get returns the record of the user, nil if the user has no description
+	Get(ctx context.Context, userID string) (*Record, error)
+	// Put stores the record, replacing the previous description of the user
+	Put(ctx context.Context, record Record) error
+}
+
+// DynamoRepository is a Repository backed by the DynamoDB table, its client is reused by every call
+type DynamoRepository struct {
+	client    *dynamodb.DynamoDB
+	tableName string
+}
+
+// NewDynamoRepository creates the DynamoDB client of the repository from the session
+func NewDynamoRepository(sess *session.Session) *DynamoRepository {
+	return &DynamoRepository{
+		client:    dynamodb.New(sess),
+		tableName: TableName,
+	}
+}
+
+// Get returns the record of the user, nil if the user has no description
+func (r *DynamoRepository) Get(ctx context.Context, userID string) (*Record, error) {
+	result, err := r.client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"userId": {S: aws.String(userID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get item from DynamoDB: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var record Record
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &record); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	return &record, nil
+}
+
+// Put stores the record, replacing the previous description of the user
+func (r *DynamoRepository) Put(ctx context.Context, record Record) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal description: %w", err)
+	}
+
+	_, err = r.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put item to DynamoDB: %w", err)
+	}
+	return nil
+}
+
+// MemoryRepository is an in-process Repository, mostly useful for tests and local runs
+type MemoryRepository struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewMemoryRepository returns an empty in-memory repository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{records: make(map[string]Record)}
+}
+
+// Get returns the record of the user, nil if the user has no description
+func (r *MemoryRepository) Get(ctx context.Context, userID string) (*Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[userID]
+	if !ok {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// Put stores the record, replacing the previous description of the user
+func (r *MemoryRepository) Put(ctx context.Context, record Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records[record.UserID] = record
+	return nil
+}
+
+// cachedRecord is a read of the wrapped repository, record is nil for a user without description
+type cachedRecord struct {
+	record  *Record
+	expires time.Time
+}
+
+// CachedRepository keeps the reads of another repository for a TTL. The writes made through it update
+// the cache, the ones made by other processes are only seen once the entry expires or is invalidated.
+type CachedRepository struct {
+	repository Repository
+	ttl        time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]cachedRecord
+	lastSweep time.Time
+}
+
+// NewCachedRepository wraps the repository with a read cache keeping the records for ttl
+func NewCachedRepository(repository Repository, ttl time.Duration) *CachedRepository {
+	return &CachedRepository{
+		repository: repository,
+		ttl:        ttl,
+		entries:    make(map[string]cachedRecord),
+		lastSweep:  time.Now(),
+	}
+}
+
+// Get returns the record of the user from the cache, or from the wrapped repository once it expired
+func (r *CachedRepository) Get(ctx context.Context, userID string) (*Record, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[userID]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return copyRecord(entry.record), nil
+	}
+
+	record, err := r.repository.Get(ctx, userID)
+	if err != nil {
+		// The errors are not cached, the next read tries again
+		return nil, err
+	}
+	r.store(userID, record)
+	return copyRecord(record), nil
+}
+
+// Put stores the record in the wrapped repository and in the cache
+func (r *CachedRepository) Put(ctx context.Context, record Record) error {
+	if err := r.repository.Put(ctx, record); err != nil {
+		// The write may have happened anyway, so the cached record can't be trusted anymore
+		r.Invalidate(record.UserID)
+		return err
+	}
+	r.store(record.UserID, &record)
+	return nil
+}
+
+// Invalidate drops the cached record of the user, the next read goes to the wrapped repository
+func (r *CachedRepository) Invalidate(userID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.entries, userID)
+}
+
+// store caches the record of the user, and drops the expired entries once per TTL so the cache doesn't grow
+// with every user ever read
+func (r *CachedRepository) store(userID string, record *Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) > r.ttl {
+		for key, entry := range r.entries {
+			if !now.Before(entry.expires) {
+				delete(r.entries, key)
+			}
+		}
+		r.lastSweep = now
+	}
+	r.entries[userID] = cachedRecord{record: copyRecord(record), expires: now.Add(r.ttl)}
+}
+
+// copyRecord returns a copy of the record, so the callers can't change the cached one
+func copyRecord(record *Record) *Record {
+	if record == nil {
+		return nil
+	}
+	copied := *record
+	return &copied
+}
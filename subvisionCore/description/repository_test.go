@@ -0,0 +1,174 @@
+package description
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// countingRepository counts the reads reaching the wrapped repository and can fail the calls
+type countingRepository struct {
+	*MemoryRepository
+	gets    int
+	failGet bool
+	failPut bool
+}
+
+func (r *countingRepository) Get(ctx context.Context, userID string) (*Record, error) {
+	r.gets++
+	if r.failGet {
+		return nil, errors.New("get failed")
+	}
+	return r.MemoryRepository.Get(ctx, userID)
+}
+
+func (r *countingRepository) Put(ctx context.Context, record Record) error {
+	if r.failPut {
+		return errors.New("put failed")
+	}
+	return r.MemoryRepository.Put(ctx, record)
+}
+
+func TestCachedRepository(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		// run uses the cache after the backing repository got the description "old" for user 1
+		run             func(t *testing.T, cache *CachedRepository, backing *countingRepository)
+		wantDescription string
+		wantGets        int
+	}{
+		{
+			name:            "reads are cached",
+			ttl:             time.Hour,
+			run:             func(t *testing.T, cache *CachedRepository, backing *countingRepository) {},
+			wantDescription: "old",
+			wantGets:        1,
+		},
+		{
+			name: "writes of other processes are not seen before the TTL",
+			ttl:  time.Hour,
+			run: func(t *testing.T, cache *CachedRepository, backing *countingRepository) {
+				backing.MemoryRepository.Put(ctx, Record{UserID: "1", Description: "new"})
+			},
+			wantDescription: "old",
+			wantGets:        1,
+		},
+		{
+			name: "expired entries are read again",
+			ttl:  time.Millisecond,
+			run: func(t *testing.T, cache *CachedRepository, backing *countingRepository) {
+				backing.MemoryRepository.Put(ctx, Record{UserID: "1", Description: "new"})
+				time.Sleep(5 * time.Millisecond)
+			},
+			wantDescription: "new",
+			wantGets:        2,
+		},
+		{
+			name: "invalidate drops the entry",
+			ttl:  time.Hour,
+			run: func(t *testing.T, cache *CachedRepository, backing *countingRepository) {
+				backing.MemoryRepository.Put(ctx, Record{UserID: "1", Description: "new"})
+				cache.Invalidate("1")
+			},
+			wantDescription: "new",
+			wantGets:        2,
+		},
+		{
+			name: "writes through the cache update it",
+			ttl:  time.Hour,
+			run: func(t *testing.T, cache *CachedRepository, backing *countingRepository) {
+				if err := cache.Put(ctx, Record{UserID: "1", Description: "new"}); err != nil {
+					t.Fatalf("Put() error = %v", err)
+				}
+			},
+			wantDescription: "new",
+			wantGets:        1,
+		},
+		{
+			name: "failed writes invalidate the entry",
+			ttl:  time.Hour,
+			run: func(t *testing.T, cache *CachedRepository, backing *countingRepository) {
+				backing.failPut = true
+				if err := cache.Put(ctx, Record{UserID: "1", Description: "new"}); err == nil {
+					t.Fatal("Put() returned no error")
+				}
+			},
+			wantDescription: "old",
+			wantGets:        2,
+		},
+		{
+			name: "errors are not cached",
+			ttl:  time.Hour,
+			run: func(t *testing.T, cache *CachedRepository, backing *countingRepository) {
+				cache.Invalidate("1")
+				backing.failGet = true
+				if _, err := cache.Get(ctx, "1"); err == nil {
+					t.Fatal("Get() returned no error")
+				}
+				backing.failGet = false
+			},
+			wantDescription: "old",
+			wantGets:        3,
+		},
+		{
+			name: "callers can't change the cached record",
+			ttl:  time.Hour,
+			run: func(t *testing.T, cache *CachedRepository, backing *countingRepository) {
+				record, err := cache.Get(ctx, "1")
+				if err != nil {
+					t.Fatalf("Get() error = %v", err)
+				}
+				record.Description = "changed"
+			},
+			wantDescription: "old",
+			wantGets:        1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backing := &countingRepository{MemoryRepository: NewMemoryRepository()}
+			backing.MemoryRepository.Put(ctx, Record{UserID: "1", Description: "old"})
+			cache := NewCachedRepository(backing, tt.ttl)
+			if _, err := cache.Get(ctx, "1"); err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+
+			tt.run(t, cache, backing)
+
+			record, err := cache.Get(ctx, "1")
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if record == nil || record.Description != tt.wantDescription {
+				t.Errorf("Get() = %+v, want description %q", record, tt.wantDescription)
+			}
+			if backing.gets != tt.wantGets {
+				t.Errorf("reads of the backing repository = %d, want %d", backing.gets, tt.wantGets)
+			}
+		})
+	}
+}
+
+func TestCachedRepositoryCachesMissingDescriptions(t *testing.T) {
+	ctx := context.Background()
+	backing := &countingRepository{MemoryRepository: NewMemoryRepository()}
+	cache := NewCachedRepository(backing, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		record, err := cache.Get(ctx, "unknown")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if record != nil {
+			t.Errorf("Get() = %+v, want nil", record)
+		}
+	}
+	if backing.gets != 1 {
+		t.Errorf("reads of the backing repository = %d, want 1", backing.gets)
+	}
+}
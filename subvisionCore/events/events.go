@@ -0,0 +1,32 @@
+// Package events defines the messages exchanged by the SubVision services through the queues:
+// the events tracker publishes a MessagePayload for every sub or cheer, genImage consumes it
+// and publishes an ImageReadyEvent for the overlay once the image is generated.
+package events
+
+// Event represents the Twitch event that triggered the generation
+type Event struct {
+	EventType string `json:"event_type"`
+	UserTier  string `json:"user_tier"`
+	Months    int    `json:"months"`
+	NBits     *int   `json:"n_bits"` // Using pointer to handle null values
+	// Quantity is the number of subscriptions gifted, only set for subgift and submysterygift
+	Quantity *int `json:"quantity"`
+}
+
+// MessagePayload is the message published by the events tracker to the subs queue
+type MessagePayload struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Datetime string `json:"datetime"`
+	Event    Event  `json:"event"`
+}
+
+// ImageReadyEvent is the message published by genImage to the ready images queue
+type ImageReadyEvent struct {
+	Username  string `json:"username"`
+	ImagePath string `json:"image_path"`
+	// ImageURL is where the image can be fetched from, ImagePath is only its key in the image store
+	ImageURL     string `json:"image_url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Rarity       string `json:"rarity,omitempty"`
+}
@@ -0,0 +1,225 @@
+// Package history is the history of the images generated for every user, written by genImage and
+// queried by the websites to show the supporters their images. The table is keyed by user ID and
+// creation time, so the images of a user are read with a single query.
+package history
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// TableName is the DynamoDB table with userId as partition key and createdAt as sort key
+const TableName = "GeneratedImages"
+
+// Record is an image generated for a user
+type Record struct {
+	UserID int `json:"userId" dynamodbav:"userId"`
+	// CreatedAt is an RFC 3339 UTC time with nanoseconds, so the records sort by time
+	CreatedAt     string `json:"createdAt" dynamodbav:"createdAt"`
+	Username      string `json:"username" dynamodbav:"username"`
+	ImagePath     string `json:"imagePath" dynamodbav:"imagePath"`
+	ThumbnailPath string `json:"thumbnailPath,omitempty" dynamodbav:"thumbnailPath,omitempty"`
+	Rarity        string `json:"rarity" dynamodbav:"rarity"`
+	EventType     string `json:"eventType" dynamodbav:"eventType"`
+	EventKey      string `json:"eventKey" dynamodbav:"eventKey"`
+	Provider      string `json:"provider" dynamodbav:"provider"`
+	Model         string `json:"model" dynamodbav:"model"`
+}
+
+// Query selects the images of a user, the zero values don't filter
+type Query struct {
+	UserID int
+	Since  time.Time
+	Until  time.Time
+	// Limit is the maximum number of records returned, the newest first
+	Limit int
+}
+
+// Store records the generated images of every user
+type Store interface {
+	// Put records a generated image
+	Put(ctx context.Context, record Record) error
+	// List returns the images of the user matching the query, the newest first
+	List(ctx context.Context, query Query) ([]Record, error)
+	// Count returns the number of images the user received
+	Count(ctx context.Context, userID int) (int, error)
+}
+
+// FormatTime formats the creation time of a record
+func FormatTime(t time.Time) string {
+	// fixed width fraction, so the strings sort like the times
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z07:00")
+}
+
+// MemoryStore is an in-process Store, mostly useful for tests and local runs
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[int][]Record
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[int][]Record)}
+}
+
+// Put records a generated image
+func (s *MemoryStore) Put(ctx context.Context, record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := append(s.records[record.UserID], record)
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt < records[j].CreatedAt
+	})
+	s.records[record.UserID] = records
+	return nil
+}
+
+// List returns the images of the user matching the query, the newest first
+func (s *MemoryStore) List(ctx context.Context, query Query) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := s.records[query.UserID]
+	var matching []Record
+	for i := len(records) - 1; i >= 0; i-- {
+		if !query.Since.IsZero() && records[i].CreatedAt < FormatTime(query.Since) {
+			continue
+		}
+		if !query.Until.IsZero() && records[i].CreatedAt >= FormatTime(query.Until) {
+			continue
+		}
+		matching = append(matching, records[i])
+		if query.Limit > 0 && len(matching) == query.Limit {
+			break
+		}
+	}
+	return matching, nil
+}
+
+// Count returns the number of images the user received
+func (s *MemoryStore) Count(ctx context.Context, userID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.records[userID]), nil
+}
+
+// DynamoStore is a Store backed by the DynamoDB table, its client is reused by every call
+type DynamoStore struct {
+	client    *dynamodb.DynamoDB
+	tableName string
+}
+
+// NewDynamoStore creates the DynamoDB client of the store from the session
+func NewDynamoStore(sess *session.Session) *DynamoStore {
+	return &DynamoStore{
+		client:    dynamodb.New(sess),
+		tableName: TableName,
+	}
+}
+
+// Put records a generated image
+func (s *DynamoStore) Put(ctx context.Context, record Record) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal generated image: %w", err)
+	}
+
+	_, err = s.client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put generated image to DynamoDB: %w", err)
+	}
+	return nil
+}
+
+// keyCondition returns the key condition selecting the records of the query
+func (s *DynamoStore) keyCondition(query Query) (string, map[string]*dynamodb.AttributeValue) {
+	condition := "userId = :userId"
+	values := map[string]*dynamodb.AttributeValue{
+		":userId": {N: aws.String(strconv.Itoa(query.UserID))},
+	}
+
+	switch {
+	case !query.Since.IsZero() && !query.Until.IsZero():
+		// BETWEEN includes the upper bound, Until is excluded by the nanosecond before
+		condition += " AND createdAt BETWEEN :since AND :until"
+		values[":since"] = &dynamodb.AttributeValue{S: aws.String(FormatTime(query.Since))}
+		values[":until"] = &dynamodb.AttributeValue{S: aws.String(FormatTime(query.Until.Add(-time.Nanosecond)))}
+	case !query.Since.IsZero():
+		condition += " AND createdAt >= :since"
+		values[":since"] = &dynamodb.AttributeValue{S: aws.String(FormatTime(query.Since))}
+	case !query.Until.IsZero():
+		condition += " AND createdAt < :until"
+		values[":until"] = &dynamodb.AttributeValue{S: aws.String(FormatTime(query.Until))}
+	}
+	return condition, values
+}
+
+// List returns the images of the user matching the query, the newest first
+func (s *DynamoStore) List(ctx context.Context, query Query) ([]Record, error) {
+	condition, values := s.keyCondition(query)
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tableName),
+		KeyConditionExpression:    aws.String(condition),
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(false),
+	}
+	if query.Limit > 0 {
+		input.Limit = aws.Int64(int64(query.Limit))
+	}
+
+	var records []Record
+	var unmarshalErr error
+	err := s.client.QueryPagesWithContext(ctx, input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		var pageRecords []Record
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageRecords); unmarshalErr != nil {
+			return false
+		}
+		records = append(records, pageRecords...)
+		return query.Limit <= 0 || len(records) < query.Limit
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query generated images from DynamoDB: %w", err)
+	}
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal generated images: %w", unmarshalErr)
+	}
+
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[:query.Limit]
+	}
+	return records, nil
+}
+
+// Count returns the number of images the user received
+func (s *DynamoStore) Count(ctx context.Context, userID int) (int, error) {
+	condition, values := s.keyCondition(Query{UserID: userID})
+
+	count := 0
+	err := s.client.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tableName),
+		KeyConditionExpression:    aws.String(condition),
+		ExpressionAttributeValues: values,
+		Select:                    aws.String(dynamodb.SelectCount),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		count += int(aws.Int64Value(page.Count))
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count generated images in DynamoDB: %w", err)
+	}
+	return count, nil
+}
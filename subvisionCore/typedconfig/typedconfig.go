@@ -0,0 +1,45 @@
+// Package typedconfig loads the typed JSON settings of the services. Every service declares its settings
+// as a struct with defaults, the file only has to hold what differs from them.
+package typedconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Validator is implemented by the settings that check their values once loaded
+type Validator interface {
+	Validate() error
+}
+
+// Load reads the JSON file on top of the defaults. An unknown key is an error so a typo doesn't silently
+// leave a setting to its default. If the file can't be read the defaults are returned with the error,
+// which wraps fs.ErrNotExist for a missing file so the services with an optional file can keep the defaults.
+func Load[T any](path string, defaults T) (T, error) {
+	settings := defaults
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return settings, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		return settings, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return settings, validate(path, &settings)
+}
+
+// validate runs the Validate method of the settings if they have one
+func validate(path string, settings any) error {
+	if validator, ok := settings.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return fmt.Errorf("invalid %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package typedconfig
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testSettings struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func (s *testSettings) Validate() error {
+	if s.Count < 0 {
+		return errors.New("count must not be negative")
+	}
+	return nil
+}
+
+func TestLoad(t *testing.T) {
+	defaults := testSettings{Name: "default", Count: 1}
+
+	tests := []struct {
+		name string
+		// content is the content of the file, missing if nil
+		content      *string
+		want         testSettings
+		wantErr      bool
+		wantNotExist bool
+	}{
+		{name: "missing file keeps the defaults", want: defaults, wantErr: true, wantNotExist: true},
+		{name: "file overrides the defaults", content: ptr(`{"count": 2}`), want: testSettings{Name: "default", Count: 2}},
+		{name: "unknown key", content: ptr(`{"cuont": 2}`), wantErr: true},
+		{name: "invalid JSON", content: ptr(`{`), wantErr: true},
+		{name: "invalid settings", content: ptr(`{"count": -1}`), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "settings.json")
+			if tt.content != nil {
+				if err := os.WriteFile(path, []byte(*tt.content), 0o644); err != nil {
+					t.Fatalf("WriteFile() error = %v", err)
+				}
+			}
+
+			got, err := Load(path, defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, fs.ErrNotExist) != tt.wantNotExist {
+				t.Errorf("Load() error = %v, want fs.ErrNotExist %v", err, tt.wantNotExist)
+			}
+			if !tt.wantErr || tt.wantNotExist {
+				if got != tt.want {
+					t.Errorf("Load() = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -5,6 +5,10 @@ go 1.21
 require (
 	github.com/aws/aws-sdk-go v1.44.327
 	github.com/gorilla/websocket v1.5.0
+	subvisionCore v0.0.0
 )
 
 require github.com/jmespath/go-jmespath v0.4.0 // indirect
+
+// the core module is shared by the services of the repository
+replace subvisionCore => ../subvisionCore
@@ -5,13 +5,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"path"
+	"strings"
 	"time"
 
 	"websiteOverlay/config"
 
+	"subvisionCore/awsclient"
+	"subvisionCore/events"
+
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/gorilla/websocket"
 )
@@ -46,11 +49,8 @@ type SQSMessage struct {
 	Timestamp string `json:"timestamp"`
 }
 
-// ImageReadyEvent structure from the queue
-type ImageReadyEvent struct {
-	Username  string `json:"username"`
-	ImagePath string `json:"image_path"`
-}
+// ImageReadyEvent structure from the queue, published by genImage
+type ImageReadyEvent = events.ImageReadyEvent
 
 // Event structure to send to frontend
 type Event struct {
@@ -62,13 +62,10 @@ type Event struct {
 func main() {
 	// Initialize AWS session
 	awsSecrets := config.GetAWSSecrets()
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(awsSecrets.Region),
-		Credentials: credentials.NewStaticCredentials(
-			awsSecrets.AccessKeyID,
-			awsSecrets.SecretAccessKey,
-			"",
-		),
+	sess, err := awsclient.NewSession(awsclient.Credentials{
+		Region:          awsSecrets.Region,
+		AccessKeyID:     awsSecrets.AccessKeyID,
+		SecretAccessKey: awsSecrets.SecretAccessKey,
 	})
 	if err != nil {
 		log.Fatal("Failed to create AWS session:", err)
@@ -89,12 +86,25 @@ func main() {
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/ws", handleWebSocket)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
-	http.Handle("/output_images/", http.StripPrefix("/output_images/", http.FileServer(http.Dir("output_images/"))))
+	http.Handle("/output_images/", http.StripPrefix("/output_images/", imagesOnly(http.FileServer(http.Dir("output_images/")))))
 
 	fmt.Println("Server starting on :8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
+// imagesOnly serves the image files only: no directory listing, and none of the metadata sidecars
+// older versions of genImage wrote next to the images
+func imagesOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(path.Ext(r.URL.Path)) {
+		case ".png", ".jpg", ".jpeg", ".webp", ".gif":
+			next.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
 // Serve the main HTML page
 func serveHome(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "static/index.html")
@@ -232,21 +242,32 @@ func pollSQSQueue(sqsClient *sqs.SQS, queueURL string) {
 					Timestamp: time.Now().Format(time.RFC3339),
 				}
 			} else {
-				// Add the folder path to the image path
-				imageEvent.ImagePath = "/output_images/" + imageEvent.ImagePath
+				// Events of older genImage versions only carry the file name in the local folder
+				if imageEvent.ImageURL != "" {
+					imageEvent.ImagePath = imageEvent.ImageURL
+				} else {
+					imageEvent.ImagePath = "/output_images/" + imageEvent.ImagePath
+				}
 
 				// Successfully parsed ImageReadyEvent
-				log.Printf("Parsed ImageReadyEvent - Username: %s, ImagePath: %s", imageEvent.Username, imageEvent.ImagePath)
+				log.Printf("Parsed ImageReadyEvent - Username: %s, ImagePath: %s, Rarity: %s", imageEvent.Username, imageEvent.ImagePath, imageEvent.Rarity)
+
+				data := map[string]interface{}{
+					"username":  imageEvent.Username,
+					"imagePath": imageEvent.ImagePath,
+					"rarity":    imageEvent.Rarity,
+					"messageId": *message.MessageId,
+					"receipt":   *message.ReceiptHandle,
+				}
+				// The thumbnail is shown while the full image loads, older genImage versions don't send it
+				if imageEvent.ThumbnailURL != "" {
+					data["thumbnailPath"] = imageEvent.ThumbnailURL
+				}
 
 				// Create event for frontend with structured data
 				event = Event{
-					Type: "image_ready",
-					Data: map[string]interface{}{
-						"username":  imageEvent.Username,
-						"imagePath": imageEvent.ImagePath,
-						"messageId": *message.MessageId,
-						"receipt":   *message.ReceiptHandle,
-					},
+					Type:      "image_ready",
+					Data:      data,
 					Timestamp: time.Now().Format(time.RFC3339),
 				}
 			}
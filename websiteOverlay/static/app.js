@@ -145,13 +145,29 @@ class OverlayMonitor {
             const imagePath = eventData.data.imagePath || '';
             const messageId = eventData.data.messageId || '';
             const imageUrl = `${imagePath}`;
+            // Rarity names are used as CSS classes, anything unexpected is shown as common
+            const rarity = /^[a-z]+$/.test(eventData.data.rarity || '') ? eventData.data.rarity : 'common';
+            const rarityBadge = rarity !== 'common'
+                ? `<div class="rarity-badge">${this.escapeHtml(rarity)}</div>`
+                : '';
+            
+            const thumbnailUrl = eventData.data.thumbnailPath || '';
             
             this.eventDisplay.innerHTML = `
-                <div class="image-overlay">
-                    <img src="${imageUrl}" alt="Generated Image" class="overlay-image" />
+                <div class="image-overlay rarity-${rarity}">
+                    ${rarityBadge}
+                    <img src="${thumbnailUrl || imageUrl}" alt="Generated Image" class="overlay-image" />
                     <div class="username-display">${this.escapeHtml(username)}</div>
                 </div>
             `;
+
+            // The small thumbnail shows up right away, the full image replaces it once downloaded
+            if (thumbnailUrl) {
+                const image = this.eventDisplay.querySelector('.overlay-image');
+                const fullImage = new Image();
+                fullImage.onload = () => { image.src = imageUrl; };
+                fullImage.src = imageUrl;
+            }
         } else {
             // Handle other event types (sqs_message, etc.)
             let content = '';
@@ -2,15 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"strings"
 	"time"
 	
 	"websiteUserDescription/config"
 
+	"subvisionCore/typedconfig"
+
 	"google.golang.org/genai"
 )
 
@@ -29,16 +29,25 @@ type SafetyPrompt struct {
 	ExpectedResponses   []string `json:"expected_responses"`
 }
 
+// Validate checks that the safety prompt file set the prompts and the expected responses
+func (p *SafetyPrompt) Validate() error {
+	if p.SystemPrompt == "" || p.UserPromptTemplate == "" {
+		return fmt.Errorf("system_prompt and user_prompt_template are required")
+	}
+	if !strings.Contains(p.UserPromptTemplate, "{description}") {
+		return fmt.Errorf("user_prompt_template has no {description} placeholder")
+	}
+	if len(p.ExpectedResponses) == 0 {
+		return fmt.Errorf("expected_responses is required")
+	}
+	return nil
+}
+
 // loadSafetyPrompt loads the safety prompt configuration from JSON file
 func loadSafetyPrompt() (*SafetyPrompt, error) {
-	data, err := os.ReadFile("safety_prompt.json")
+	prompt, err := typedconfig.Load("safety_prompt.json", SafetyPrompt{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read safety prompt file: %w", err)
-	}
-	
-	var prompt SafetyPrompt
-	if err := json.Unmarshal(data, &prompt); err != nil {
-		return nil, fmt.Errorf("failed to parse safety prompt JSON: %w", err)
+		return nil, fmt.Errorf("failed to load safety prompt: %w", err)
 	}
 	
 	return &prompt, nil
@@ -3,15 +3,16 @@ module websiteUserDescription
 go 1.24.0
 
 require (
-	github.com/aws/aws-sdk-go v1.55.8
+	github.com/clerk/clerk-sdk-go/v2 v2.4.0
 	google.golang.org/genai v1.23.0
+	subvisionCore v0.0.0
 )
 
 require (
 	cloud.google.com/go v0.116.0 // indirect
 	cloud.google.com/go/auth v0.9.3 // indirect
 	cloud.google.com/go/compute/metadata v0.5.0 // indirect
-	github.com/clerk/clerk-sdk-go/v2 v2.4.0 // indirect
+	github.com/aws/aws-sdk-go v1.55.8 // indirect
 	github.com/go-jose/go-jose/v3 v3.0.4 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
@@ -28,3 +29,6 @@ require (
 	google.golang.org/grpc v1.66.2 // indirect
 	google.golang.org/protobuf v1.34.2 // indirect
 )
+
+// the core module is shared by the services of the repository
+replace subvisionCore => ../subvisionCore
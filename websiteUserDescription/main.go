@@ -9,6 +9,8 @@ import (
 
 	"websiteUserDescription/config"
 
+	"subvisionCore/description"
+
 	"github.com/clerk/clerk-sdk-go/v2"
 	clerkhttp "github.com/clerk/clerk-sdk-go/v2/http"
 	"github.com/clerk/clerk-sdk-go/v2/user"
@@ -42,6 +44,13 @@ func main() {
 	clerkSecrets := config.GetClerkSecrets()
 	clerk.SetKey(clerkSecrets.SecretKey)
 
+	// The repository and its DynamoDB client are shared by every request
+	repository, err := newDescriptionRepository()
+	if err != nil {
+		log.Fatalf("Error creating description repository: %v", err)
+	}
+	descriptions = repository
+
 	mux := http.NewServeMux()
 
 	// Serve static files
@@ -92,7 +101,7 @@ func getUserData(w http.ResponseWriter, r *http.Request) {
 	var username string = *usr.ExternalAccounts[0].Username
 	var twitchUserId string = usr.ExternalAccounts[0].ProviderUserID
 
-	userData := getUserDescription(twitchUserId)
+	userData := getUserDescription(r.Context(), twitchUserId)
 
     userDataWithUsername := GetUserDataResponse{
         UserID:      userData.UserID,
@@ -152,8 +161,8 @@ func submitDescription(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check that description was not submitted too recently, if it was updated less than 10 seconds ago, reject
-	lastUpdated := getLastUpdated(twitchUserId)
-	parsedTime, err := time.ParseInLocation("2006-01-02 15:04:05", lastUpdated, time.Local)
+	current := getUserDescription(r.Context(), twitchUserId)
+	parsedTime, err := time.ParseInLocation(description.TimeLayout, current.LastUpdated, time.Local)
 	if err == nil && time.Since(parsedTime).Seconds() < 10 {
 		response = SetUserDescriptionResponse{
 			Success: false,
@@ -170,7 +179,7 @@ func submitDescription(w http.ResponseWriter, r *http.Request) {
 	isValid := checkDescriptionWithLLM(req.Description)
 	if isValid {
 		// Store in database (placeholder for now)
-		success := storeUserDescription(twitchUserId, req.Description)
+		success := storeUserDescription(r.Context(), twitchUserId, req.Description)
 		if success {
 			response = SetUserDescriptionResponse{
 				Success: true,
@@ -1,78 +1,58 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"time"
 
 	"websiteUserDescription/config"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"subvisionCore/awsclient"
+	"subvisionCore/description"
 )
 
-// UserDescriptionItem represents the structure of the DynamoDB item
-type UserDescriptionItem struct {
-	UserID      string `json:"userId" dynamodbav:"userId"`
-	Description string `json:"description" dynamodbav:"description"`
-	LastUpdated string `json:"lastUpdated" dynamodbav:"lastUpdated"`
-}
+// descriptionCacheTTL is how long a read description is kept, the writes of the website update the cache
+const descriptionCacheTTL = 5 * time.Minute
 
-// getUserDescription retrieves user description from DynamoDB
-func getUserDescription(userID string) UserDescriptionResponse {
-	log.Printf("Getting description for user ID: %s", userID)
+// descriptions is the repository shared by the requests, created once in main
+var descriptions description.Repository
 
+// newDescriptionRepository creates the cached DynamoDB repository of the descriptions
+func newDescriptionRepository() (description.Repository, error) {
 	// Get AWS configuration
 	awsSecrets := config.GetAWSSecrets()
 
 	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(awsSecrets.Region),
-		Credentials: credentials.NewStaticCredentials(
-			awsSecrets.AccessKeyID,
-			awsSecrets.SecretAccessKey,
-			"",
-		),
+	sess, err := awsclient.NewSession(awsclient.Credentials{
+		Region:          awsSecrets.Region,
+		AccessKeyID:     awsSecrets.AccessKeyID,
+		SecretAccessKey: awsSecrets.SecretAccessKey,
 	})
 	if err != nil {
-		log.Printf("Error creating AWS session: %v", err)
-		// Return mock data as fallback
-		return UserDescriptionResponse{
-			UserID:      userID,
-			Description: "Unable to retrieve description from database. Please try again later.",
-			LastUpdated: time.Unix(0, 0).Format("2006-01-02 15:04:05"),
-		}
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
 	}
 
-	// Create DynamoDB client
-	svc := dynamodb.New(sess)
-
-	// Prepare the GetItem input
-	input := &dynamodb.GetItemInput{
-		TableName: aws.String("UserDescription"),
-		Key: map[string]*dynamodb.AttributeValue{
-			"userId": {
-				S: aws.String(userID),
-			},
-		},
-	}
+	return description.NewCachedRepository(description.NewDynamoRepository(sess), descriptionCacheTTL), nil
+}
 
-	// Execute the GetItem operation
-	result, err := svc.GetItem(input)
+// getUserDescription retrieves user description from the repository
+func getUserDescription(ctx context.Context, userID string) UserDescriptionResponse {
+	log.Printf("Getting description for user ID: %s", userID)
+
+	record, err := descriptions.Get(ctx, userID)
 	if err != nil {
-		log.Printf("Error getting item from DynamoDB: %v", err)
+		log.Printf("Error getting description: %v", err)
 		// Return mock data as fallback
 		return UserDescriptionResponse{
 			UserID:      userID,
 			Description: "Unable to retrieve description from database. Please try again later.",
-			LastUpdated: time.Unix(0, 0).Format("2006-01-02 15:04:05"),
+			LastUpdated: time.Unix(0, 0).Format(description.TimeLayout),
 		}
 	}
 
 	// Check if item was found
-	if result.Item == nil {
+	if record == nil {
 		log.Printf("No description found for user ID: %s", userID)
 		// Return empty description for new users
 		return UserDescriptionResponse{
@@ -82,80 +62,26 @@ func getUserDescription(userID string) UserDescriptionResponse {
 		}
 	}
 
-	// Unmarshal the result into our struct
-	var item UserDescriptionItem
-	err = dynamodbattribute.UnmarshalMap(result.Item, &item)
-	if err != nil {
-		log.Printf("Error unmarshaling DynamoDB item: %v", err)
-		// Return mock data as fallback
-		return UserDescriptionResponse{
-			UserID:      userID,
-			Description: "Error reading description from database. Please try again later.",
-			LastUpdated: time.Unix(0, 0).Format("2006-01-02 15:04:05"),
-		}
-	}
-
 	log.Printf("Successfully retrieved description for user ID: %s", userID)
-	return UserDescriptionResponse(item)
+	return UserDescriptionResponse(*record)
 }
 
-// storeUserDescription saves user description to DynamoDB
-func storeUserDescription(userID, description string) bool {
+// storeUserDescription saves user description to the repository
+func storeUserDescription(ctx context.Context, userID, text string) bool {
 	log.Printf("Storing description for user ID: %s", userID)
 
-	// Get AWS configuration
-	awsSecrets := config.GetAWSSecrets()
-
-	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(awsSecrets.Region),
-		Credentials: credentials.NewStaticCredentials(
-			awsSecrets.AccessKeyID,
-			awsSecrets.SecretAccessKey,
-			"",
-		),
-	})
-	if err != nil {
-		log.Printf("Error creating AWS session: %v", err)
-		return false
-	}
-
-	// Create DynamoDB client
-	svc := dynamodb.New(sess)
-
 	// Create the item to store
-	item := UserDescriptionItem{
+	record := description.Record{
 		UserID:      userID,
-		Description: description,
-		LastUpdated: time.Now().Format("2006-01-02 15:04:05"),
+		Description: text,
+		LastUpdated: time.Now().Format(description.TimeLayout),
 	}
 
-	// Marshal the item
-	av, err := dynamodbattribute.MarshalMap(item)
-	if err != nil {
-		log.Printf("Error marshaling item: %v", err)
-		return false
-	}
-
-	// Prepare the PutItem input
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String("UserDescription"),
-		Item:      av,
-	}
-
-	// Execute the PutItem operation
-	_, err = svc.PutItem(input)
-	if err != nil {
-		log.Printf("Error putting item to DynamoDB: %v", err)
+	if err := descriptions.Put(ctx, record); err != nil {
+		log.Printf("Error storing description: %v", err)
 		return false
 	}
 
 	log.Printf("Successfully stored description for user ID: %s", userID)
 	return true
 }
-
-// getLastUpdated retrieves the last updated timestamp for a user
-func getLastUpdated(userID string) string {
-	userData := getUserDescription(userID)
-	return userData.LastUpdated
-}